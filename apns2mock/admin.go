@@ -0,0 +1,400 @@
+// Copyright 2017 Aleksey Blinov. All rights reserved.
+
+package apns2mock
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+// AdminHandler returns http.Handler serving server's admin API.
+// The API allows non-Go clients to control the server and to inspect
+// notifications it has received. All request and response bodies are
+// JSON encoded. Durations are expressed as strings accepted by
+// time.ParseDuration, e.g. "250ms".
+//
+//	POST   /available            resume normal request handling
+//	POST   /unavailable          respond to all requests with {"status": 503, "reason": "ServiceUnavailable"}
+//	POST   /faulty               fail all requests with {"mode": "reset-stream", "code": 7} network fault
+//	GET    /comms                get {"connection_delay": "1s", "response_time": "20ms", "latency": "normal:20ms,5ms"}
+//	PUT    /comms                change connection delay, response time and/or latency
+//	GET    /responses            list per-token responses
+//	POST   /responses            set {"token": "...", "status": 410, "reason": "Unregistered"}
+//	DELETE /responses[?token=t]  remove response for token t or all responses
+//	GET    /notifications[?token=t]  list received notifications
+//	DELETE /notifications        discard received notifications
+//	GET    /stats                get request and connection counters
+//	GET    /connections          list open client connections
+//	POST   /goaway               send {"code": 0, "debug_data": "...", "connections": [1, 2]} GOAWAY
+//	POST   /handshake-faults     fail {"fault": "expired-cert", "every": 3, "percent": 0} TLS handshakes
+//
+// Handshake fault may also be given as accepted by ParseHandshakeFaults,
+// e.g. {"fault": "alert/3"}. Every and percent, if set, replace
+// the selector it specifies.
+//
+// Successful requests that do not return any data are responded to
+// with 204 status.
+func (s *Server) AdminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/available", s.adminAvailable)
+	mux.HandleFunc("/unavailable", s.adminUnavailable)
+	mux.HandleFunc("/faulty", s.adminFaulty)
+	mux.HandleFunc("/comms", s.adminComms)
+	mux.HandleFunc("/responses", s.adminResponses)
+	mux.HandleFunc("/notifications", s.adminNotifications)
+	mux.HandleFunc("/stats", s.adminStats)
+	mux.HandleFunc("/connections", s.adminConnections)
+	mux.HandleFunc("/goaway", s.adminGoAway)
+	mux.HandleFunc("/handshake-faults", s.adminHandshakeFaults)
+	return mux
+}
+
+// ServeAdmin starts serving admin API over plain HTTP on the specified
+// network address. It returns the base URL of the API. The listener
+// is closed when the server is closed. See AdminHandler for the description
+// of the API.
+func (s *Server) ServeAdmin(addr string) (string, error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return "", err
+	}
+	srv := &http.Server{Handler: s.AdminHandler()}
+	s.mu.Lock()
+	prev := s.admin
+	s.admin = srv
+	s.mu.Unlock()
+	if prev != nil {
+		prev.Close()
+	}
+	go srv.Serve(l)
+	return "http://" + l.Addr().String(), nil
+}
+
+func (s *Server) closeAdmin() {
+	s.mu.Lock()
+	srv := s.admin
+	s.admin = nil
+	s.mu.Unlock()
+	if srv != nil {
+		srv.Close()
+	}
+}
+
+// adminDurations is JSON representation of CommsCfg delays.
+type adminDurations struct {
+	ConnectionDelay string `json:"connection_delay,omitempty"`
+	ResponseTime    string `json:"response_time,omitempty"`
+	Latency         string `json:"latency,omitempty"`
+}
+
+// adminNotification is JSON representation of Notification.
+type adminNotification struct {
+	ID          string                 `json:"id"`
+	ConnID      uint64                 `json:"conn_id"`
+	Time        time.Time              `json:"time"`
+	DeviceToken string                 `json:"device_token"`
+	Header      http.Header            `json:"header"`
+	TokenHeader map[string]interface{} `json:"token_header,omitempty"`
+	TokenClaims map[string]interface{} `json:"token_claims,omitempty"`
+	RawPayload  string                 `json:"raw_payload"`
+	Payload     map[string]interface{} `json:"payload,omitempty"`
+	Status      int                    `json:"status"`
+	Reason      string                 `json:"reason,omitempty"`
+	NetFault    string                 `json:"net_fault,omitempty"`
+}
+
+// adminNetFault is JSON representation of NetFault.
+type adminNetFault struct {
+	Mode string `json:"mode"`
+	Code uint32 `json:"code,omitempty"`
+}
+
+// adminGoAway is JSON representation of GOAWAY request.
+type adminGoAway struct {
+	Code        uint32   `json:"code"`
+	DebugData   string   `json:"debug_data,omitempty"`
+	Connections []uint64 `json:"connections,omitempty"`
+}
+
+// adminHandshakeFaults is JSON representation of HandshakeFaults.
+// Fields that are not set are nil.
+type adminHandshakeFaults struct {
+	Fault   string   `json:"fault"`
+	Every   *uint64  `json:"every,omitempty"`
+	Percent *float64 `json:"percent,omitempty"`
+	Seed    *int64   `json:"seed,omitempty"`
+}
+
+// adminTokenResponse is JSON representation of per-token response.
+type adminTokenResponse struct {
+	Token string `json:"token"`
+	TokenResponse
+}
+
+func (s *Server) adminAvailable(w http.ResponseWriter, r *http.Request) {
+	if !adminMethod(w, r, "POST") {
+		return
+	}
+	s.BecomeAvailable()
+	w.WriteHeader(204)
+}
+
+func (s *Server) adminUnavailable(w http.ResponseWriter, r *http.Request) {
+	if !adminMethod(w, r, "POST") {
+		return
+	}
+	v := TokenResponse{Status: 503, Reason: "ServiceUnavailable"}
+	if !adminDecode(w, r, &v) || !adminStatus(w, v.Status) {
+		return
+	}
+	s.BecomeUnavailable(v.Status, v.Reason)
+	w.WriteHeader(204)
+}
+
+func (s *Server) adminFaulty(w http.ResponseWriter, r *http.Request) {
+	if !adminMethod(w, r, "POST") {
+		return
+	}
+	var v adminNetFault
+	if !adminDecode(w, r, &v) {
+		return
+	}
+	m, ok := parseNetFaultMode(v.Mode)
+	if !ok {
+		adminError(w, 400, "unknown network fault mode "+v.Mode)
+		return
+	}
+	s.BecomeFaulty(NetFault{Mode: m, ErrCode: http2.ErrCode(v.Code)})
+	w.WriteHeader(204)
+}
+
+func (s *Server) adminGoAway(w http.ResponseWriter, r *http.Request) {
+	if !adminMethod(w, r, "POST") {
+		return
+	}
+	var v adminGoAway
+	if !adminDecode(w, r, &v) {
+		return
+	}
+	n := s.SendGoAway(http2.ErrCode(v.Code), []byte(v.DebugData), v.Connections...)
+	adminJSON(w, map[string]int{"connections": n})
+}
+
+func (s *Server) adminHandshakeFaults(w http.ResponseWriter, r *http.Request) {
+	if !adminMethod(w, r, "POST") {
+		return
+	}
+	var v adminHandshakeFaults
+	if !adminDecode(w, r, &v) {
+		return
+	}
+	f, err := ParseHandshakeFaults(v.Fault)
+	if err != nil {
+		adminError(w, 400, err.Error())
+		return
+	}
+	if v.Every != nil || v.Percent != nil {
+		f.Every, f.Percent = 0, 0
+		if v.Every != nil {
+			f.Every = *v.Every
+		}
+		if v.Percent != nil {
+			f.Percent = *v.Percent
+		}
+	}
+	if v.Seed != nil {
+		f.Seed = *v.Seed
+	}
+	if err := s.SetHandshakeFaults(f); err != nil {
+		adminError(w, 400, err.Error())
+		return
+	}
+	w.WriteHeader(204)
+}
+
+func (s *Server) adminComms(w http.ResponseWriter, r *http.Request) {
+	if !adminMethod(w, r, "GET", "PUT") {
+		return
+	}
+	if r.Method == "PUT" {
+		var v adminDurations
+		if !adminDecode(w, r, &v) {
+			return
+		}
+		var cd, rt time.Duration
+		var err error
+		if v.ConnectionDelay != "" {
+			if cd, err = time.ParseDuration(v.ConnectionDelay); err != nil {
+				adminError(w, 400, err.Error())
+				return
+			}
+		}
+		if v.ResponseTime != "" {
+			if rt, err = time.ParseDuration(v.ResponseTime); err != nil {
+				adminError(w, 400, err.Error())
+				return
+			}
+		}
+		var lat Latency
+		if v.Latency != "" {
+			if lat, err = ParseLatency(v.Latency); err != nil {
+				adminError(w, 400, err.Error())
+				return
+			}
+		}
+		if v.ConnectionDelay != "" {
+			s.SetConnectionDelay(cd)
+		}
+		if v.ResponseTime != "" {
+			s.SetResponseTime(rt)
+		}
+		if lat != nil {
+			s.SetLatency(lat)
+		}
+	}
+	cfg := s.CommsCfg()
+	res := adminDurations{
+		ConnectionDelay: cfg.ConnectionDelay.String(),
+		ResponseTime:    cfg.ResponseTime.String(),
+	}
+	if cfg.Latency != nil {
+		res.Latency = cfg.Latency.String()
+	}
+	adminJSON(w, res)
+}
+
+func (s *Server) adminResponses(w http.ResponseWriter, r *http.Request) {
+	if !adminMethod(w, r, "GET", "POST", "DELETE") {
+		return
+	}
+	switch r.Method {
+	case "GET":
+		res := []adminTokenResponse{}
+		for k, v := range s.TokenResponses() {
+			res = append(res, adminTokenResponse{Token: k, TokenResponse: v})
+		}
+		adminJSON(w, res)
+	case "POST":
+		var v adminTokenResponse
+		if !adminDecode(w, r, &v) {
+			return
+		}
+		if v.Token == "" || v.Status == 0 {
+			adminError(w, 400, "token and status are required")
+			return
+		}
+		if !adminStatus(w, v.Status) {
+			return
+		}
+		s.SetTokenResponse(v.Token, v.Status, v.Reason)
+		w.WriteHeader(204)
+	case "DELETE":
+		if t := r.URL.Query().Get("token"); t != "" {
+			s.ClearTokenResponse(t)
+		} else {
+			s.ClearTokenResponses()
+		}
+		w.WriteHeader(204)
+	}
+}
+
+func (s *Server) adminNotifications(w http.ResponseWriter, r *http.Request) {
+	if !adminMethod(w, r, "GET", "DELETE") {
+		return
+	}
+	if r.Method == "DELETE" {
+		s.Reset()
+		w.WriteHeader(204)
+		return
+	}
+	ns := s.Received()
+	if t := r.URL.Query().Get("token"); t != "" {
+		ns = s.ReceivedFor(t)
+	}
+	res := make([]adminNotification, len(ns))
+	for i, n := range ns {
+		res[i] = adminNotification{
+			ID:          n.ID,
+			ConnID:      n.ConnID,
+			Time:        n.Time,
+			DeviceToken: n.DeviceToken,
+			Header:      n.Header,
+			TokenHeader: n.TokenHeader,
+			TokenClaims: n.TokenClaims,
+			RawPayload:  string(n.RawPayload),
+			Payload:     n.Payload,
+			Status:      n.Status,
+			Reason:      n.Reason,
+		}
+		if n.NetFault != NoNetFault {
+			res[i].NetFault = n.NetFault.String()
+		}
+	}
+	adminJSON(w, res)
+}
+
+func (s *Server) adminStats(w http.ResponseWriter, r *http.Request) {
+	if !adminMethod(w, r, "GET") {
+		return
+	}
+	adminJSON(w, s.Stats())
+}
+
+func (s *Server) adminConnections(w http.ResponseWriter, r *http.Request) {
+	if !adminMethod(w, r, "GET") {
+		return
+	}
+	adminJSON(w, s.Connections())
+}
+
+// adminMethod checks that request method is one of the allowed ones
+// and responds with 405 status if it is not.
+func adminMethod(w http.ResponseWriter, r *http.Request, allowed ...string) bool {
+	for _, m := range allowed {
+		if r.Method == m {
+			return true
+		}
+	}
+	w.Header().Set("Allow", strings.Join(allowed, ", "))
+	adminError(w, 405, "method not allowed")
+	return false
+}
+
+// adminDecode decodes JSON request body into v. Empty body leaves v intact.
+func adminDecode(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	if r.ContentLength == 0 {
+		return true
+	}
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil && err != io.EOF {
+		adminError(w, 400, err.Error())
+		return false
+	}
+	return true
+}
+
+// adminStatus checks that status is one APNS responds with
+// and responds with 400 status if it is not.
+func adminStatus(w http.ResponseWriter, status int) bool {
+	if status != 200 && (status < 400 || status > 599) {
+		adminError(w, 400, "status must be 200 or between 400 and 599")
+		return false
+	}
+	return true
+}
+
+func adminJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+func adminError(w http.ResponseWriter, status int, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": msg})
+}
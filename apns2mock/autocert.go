@@ -0,0 +1,140 @@
+// Copyright 2017 Aleksey Blinov. All rights reserved.
+
+package apns2mock
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"time"
+)
+
+// DefaultCertHosts lists host names and IP addresses that auto-generated
+// server certificates are issued for unless TLSCfg specifies otherwise.
+// Clients that connect to actual APNS host names can be pointed
+// at the server with DNS overrides or /etc/hosts entries.
+var DefaultCertHosts = []string{
+	"localhost",
+	"127.0.0.1",
+	"::1",
+	"api.sandbox.push.apple.com",
+	"api.development.push.apple.com",
+	"api.push.apple.com",
+}
+
+// certAuthority issues server certificates.
+type certAuthority struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+// newCertAuthority creates a new self-signed certificate authority.
+func newCertAuthority(commonName string) (*certAuthority, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	tmpl := &x509.Certificate{
+		Subject:               pkix.Name{CommonName: commonName, Organization: []string{"APNS Mock"}},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(10 * 365 * 24 * time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	if tmpl.SerialNumber, err = serialNumber(); err != nil {
+		return nil, err
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	return &certAuthority{cert: cert, key: key}, nil
+}
+
+// tlsCertificate returns CA certificate as tls.Certificate.
+func (ca *certAuthority) tlsCertificate() *tls.Certificate {
+	return &tls.Certificate{
+		Certificate: [][]byte{ca.cert.Raw},
+		PrivateKey:  ca.key,
+		Leaf:        ca.cert,
+	}
+}
+
+// issue creates server certificate for hosts valid from notBefore
+// until notAfter. Hosts that parse as IP addresses are included
+// as IP address SANs and all others as DNS name SANs.
+func (ca *certAuthority) issue(hosts []string, notBefore, notAfter time.Time) (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	tmpl := &x509.Certificate{
+		NotBefore:   notBefore,
+		NotAfter:    notAfter,
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	if tmpl.SerialNumber, err = serialNumber(); err != nil {
+		return tls.Certificate{}, err
+	}
+	for _, h := range hosts {
+		if ip := net.ParseIP(h); ip != nil {
+			tmpl.IPAddresses = append(tmpl.IPAddresses, ip)
+		} else {
+			tmpl.DNSNames = append(tmpl.DNSNames, h)
+		}
+	}
+	if len(hosts) > 0 {
+		tmpl.Subject.CommonName = hosts[0]
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{
+		Certificate: [][]byte{der, ca.cert.Raw},
+		PrivateKey:  key,
+	}, nil
+}
+
+func serialNumber() (*big.Int, error) {
+	return rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+}
+
+// autoCertHosts returns hosts, or DefaultCertHosts if hosts is empty,
+// along with the IP address of listener address addr, if it is not
+// already included.
+func autoCertHosts(hosts []string, addr net.Addr) []string {
+	if len(hosts) == 0 {
+		hosts = DefaultCertHosts
+	}
+	res := append([]string{}, hosts...)
+	if ta, ok := addr.(*net.TCPAddr); ok && !ta.IP.IsUnspecified() {
+		for _, h := range res {
+			if ip := net.ParseIP(h); ip != nil && ip.Equal(ta.IP) {
+				return res
+			}
+		}
+		res = append(res, ta.IP.String())
+	}
+	return res
+}
+
+// RootCertificatePEM returns PEM encoded RootCertificate. Clients
+// of servers with auto-generated certificates should trust it
+// as a certificate authority.
+func (s *Server) RootCertificatePEM() []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: s.RootCertificate.Certificate[0]})
+}
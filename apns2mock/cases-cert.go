@@ -0,0 +1,99 @@
+// Copyright 2017 Aleksey Blinov. All rights reserved.
+
+package apns2mock
+
+import (
+	"crypto/x509"
+	"encoding/asn1"
+)
+
+// Apple certificate extensions marking APNS client certificates
+// as valid for development and production environments respectively.
+var (
+	oidAPNSDevelopment = asn1.ObjectIdentifier{1, 2, 840, 113635, 100, 6, 3, 1}
+	oidAPNSProduction  = asn1.ObjectIdentifier{1, 2, 840, 113635, 100, 6, 3, 2}
+)
+
+// CertHandlers deal with TLS client certificates. They do not verify
+// certificate chains and accept certificates for any environment:
+//
+// Requests without client certificate are 403, "MissingProviderToken".
+//
+// Certificates that are expired or not yet valid are 403, "BadCertificate".
+//
+// Use NewCertHandlers to validate certificates against a CA pool.
+var CertHandlers []HadlerFunc
+
+// NewCertHandlers returns case handlers that validate TLS client certificates
+// against roots and check that they are issued for env.
+//
+// If roots is nil, certificate chains are not verified, but certificate
+// validity period is still checked.
+//
+// Certificates that fail verification are 403, "BadCertificate".
+//
+// Certificates carrying Apple environment extensions that do not
+// include env are 403, "BadCertificateEnvironment". Certificates with
+// no such extensions are considered valid in both environments.
+// If env is AnyEnvironment, environment is not checked.
+func NewCertHandlers(roots *x509.CertPool, env Environment) []HadlerFunc {
+	return []HadlerFunc{
+		func(req *APNSRequest) (int, string) {
+			c := req.ClientCert
+			if c == nil {
+				return 403, "MissingProviderToken"
+			}
+			now := req.Time
+			if now.Before(c.NotBefore) || now.After(c.NotAfter) {
+				return 403, "BadCertificate"
+			}
+			if roots != nil {
+				opts := x509.VerifyOptions{
+					Roots:         roots,
+					Intermediates: x509.NewCertPool(),
+					CurrentTime:   now,
+					KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+				}
+				if len(req.ClientCertChain) > 1 {
+					for _, ic := range req.ClientCertChain[1:] {
+						opts.Intermediates.AddCert(ic)
+					}
+				}
+				if _, err := c.Verify(opts); err != nil {
+					return 403, "BadCertificate"
+				}
+			}
+			if env != AnyEnvironment && !certAllowsEnv(c, env) {
+				return 403, "BadCertificateEnvironment"
+			}
+			return 0, ""
+		},
+	}
+}
+
+// certAllowsEnv reports whether certificate c can be used in env.
+func certAllowsEnv(c *x509.Certificate, env Environment) bool {
+	dev, prod := false, false
+	for _, ext := range c.Extensions {
+		switch {
+		case ext.Id.Equal(oidAPNSDevelopment):
+			dev = true
+		case ext.Id.Equal(oidAPNSProduction):
+			prod = true
+		}
+	}
+	if !dev && !prod {
+		return true
+	}
+	switch env {
+	case Sandbox:
+		return dev
+	case Production:
+		return prod
+	}
+	return true
+}
+
+func init() {
+	CertHandlers = NewCertHandlers(nil, AnyEnvironment)
+}
@@ -12,6 +12,44 @@ package apns2mock
 // are 400, "DeviceTokenNotForTopic".
 var DeviceTokenHandlers []HadlerFunc
 
+// NewDeviceHandlers returns case handlers that evaluate device tokens
+// against devices in registry:
+//
+// Tokens not found in registry are 400, "BadDeviceToken".
+//
+// Tokens issued for environment other than env are 400, "BadDeviceToken".
+// If env is AnyEnvironment, environment is not checked.
+//
+// Topics other than device's topic or topics derived from it
+// are 400, "DeviceTokenNotForTopic".
+//
+// Unregistered device tokens are 410, "Unregistered", with the time
+// of unregistration reported in the response.
+func NewDeviceHandlers(registry *DeviceRegistry, env Environment) []HadlerFunc {
+	return []HadlerFunc{
+		func(req *APNSRequest) (int, string) {
+			d, ok := registry.Device(req.DeviceToken)
+			if !ok {
+				return 400, "BadDeviceToken"
+			}
+			if env != AnyEnvironment && d.Environment != AnyEnvironment && d.Environment != env {
+				return 400, "BadDeviceToken"
+			}
+			if !d.acceptsTopic(req.Header.Get("apns-topic")) {
+				return 400, "DeviceTokenNotForTopic"
+			}
+			if d.State == DeviceUnregistered {
+				req.Timestamp = d.UnregisteredAt
+				if req.Timestamp.IsZero() {
+					req.Timestamp = req.Time
+				}
+				return 410, "Unregistered"
+			}
+			return 0, ""
+		},
+	}
+}
+
 func init() {
 	DeviceTokenHandlers = []HadlerFunc{
 		func(req *APNSRequest) (int, string) {
@@ -0,0 +1,64 @@
+// Copyright 2017 Aleksey Blinov. All rights reserved.
+
+package apns2mock
+
+import (
+	"strings"
+)
+
+// PushTypes lists valid values of apns-push-type header along with topic
+// suffixes required for each push type.
+var PushTypes = map[string]string{
+	"alert":        "",
+	"background":   "",
+	"voip":         ".voip",
+	"complication": ".complication",
+	"fileprovider": ".pushkit.fileprovider",
+	"mdm":          "",
+	"location":     ".location-query",
+	"liveactivity": ".push-type.liveactivity",
+	"pushtotalk":   ".voip-ptt",
+}
+
+// PushTypeHandlers deal with apns-push-type header:
+//
+// Push types not listed in PushTypes are 400, "InvalidPushType".
+//
+// Background pushes with priority other than 5 are 400, "BadPriority".
+//
+// Push-to-talk pushes with priority other than 10 are 400, "BadPriority".
+//
+// Topics missing the suffix required by push type, such as ".voip" for voip
+// pushes, are 400, "TopicDisallowed".
+//
+// Requests without apns-push-type header are not checked.
+var PushTypeHandlers []HadlerFunc
+
+func init() {
+	PushTypeHandlers = []HadlerFunc{
+		func(req *APNSRequest) (int, string) {
+			pt := req.Header.Get("apns-push-type")
+			if pt == "" {
+				return 0, ""
+			}
+			suffix, ok := PushTypes[pt]
+			if !ok {
+				return 400, "InvalidPushType"
+			}
+			switch p := req.Header.Get("apns-priority"); pt {
+			case "background":
+				if p != "5" {
+					return 400, "BadPriority"
+				}
+			case "pushtotalk":
+				if p != "" && p != "10" {
+					return 400, "BadPriority"
+				}
+			}
+			if !strings.HasSuffix(req.Header.Get("apns-topic"), suffix) {
+				return 400, "TopicDisallowed"
+			}
+			return 0, ""
+		},
+	}
+}
@@ -0,0 +1,112 @@
+// Copyright 2017 Aleksey Blinov. All rights reserved.
+
+package apns2mock
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RateLimit limits the number of requests for a single device token
+// within a sliding time window.
+type RateLimit struct {
+
+	// Window is the length of the sliding time window. It must be positive.
+	Window time.Duration
+
+	// Max is the maximum number of requests allowed within the window.
+	// It must be positive.
+	Max int
+}
+
+// NewRateLimitHandlers returns case handlers that track the rate of requests
+// for each device token. Requests for device tokens exceeding any of
+// the limits are 429, "TooManyRequests". Rejected requests do not count
+// towards the limits, so clients that back off are eventually let through.
+//
+// Returned case handlers keep their own state and should not be shared
+// between unrelated servers. Device tokens are forgotten once they
+// see no requests for the longest of the windows.
+func NewRateLimitHandlers(limits ...RateLimit) ([]HadlerFunc, error) {
+	rl := &rateLimiter{limits: append([]RateLimit{}, limits...), seen: map[string][]time.Time{}}
+	for _, l := range limits {
+		if l.Window <= 0 || l.Max <= 0 {
+			return nil, errors.New("apns2mock: rate limit window and max must be positive")
+		}
+		if l.Window > rl.maxWindow {
+			rl.maxWindow = l.Window
+		}
+	}
+	return []HadlerFunc{
+		func(req *APNSRequest) (int, string) {
+			if !rl.allow(strings.ToLower(req.DeviceToken), req.Time) {
+				return 429, "TooManyRequests"
+			}
+			return 0, ""
+		},
+	}, nil
+}
+
+// rateLimiter keeps times of recent requests for each device token.
+type rateLimiter struct {
+	limits    []RateLimit
+	maxWindow time.Duration
+
+	mu   sync.Mutex
+	seen map[string][]time.Time
+
+	// swept is the time seen was last swept of idle device tokens.
+	swept time.Time
+}
+
+// allow records request for device token made at time now unless
+// it exceeds any of the limits, in which case it returns false.
+func (rl *rateLimiter) allow(token string, now time.Time) bool {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	if now.Sub(rl.swept) > rl.maxWindow {
+		rl.sweep(now)
+	}
+	ts := rl.seen[token]
+	// Forget requests that fall outside of all windows.
+	i := 0
+	for i < len(ts) && !ts[i].After(now.Add(-rl.maxWindow)) {
+		i++
+	}
+	ts = ts[i:]
+	for _, l := range rl.limits {
+		cnt := 0
+		for _, t := range ts {
+			if t.After(now.Add(-l.Window)) {
+				cnt++
+			}
+		}
+		if cnt >= l.Max {
+			rl.store(token, ts)
+			return false
+		}
+	}
+	rl.store(token, append(ts, now))
+	return true
+}
+
+// sweep forgets device tokens with no requests within the longest window
+// before now. It must be called with rl.mu held.
+func (rl *rateLimiter) sweep(now time.Time) {
+	for token, ts := range rl.seen {
+		if !ts[len(ts)-1].After(now.Add(-rl.maxWindow)) {
+			delete(rl.seen, token)
+		}
+	}
+	rl.swept = now
+}
+
+func (rl *rateLimiter) store(token string, ts []time.Time) {
+	if len(ts) == 0 {
+		delete(rl.seen, token)
+		return
+	}
+	rl.seen[token] = ts
+}
@@ -8,7 +8,10 @@ import (
 
 // AuthTokenHandlers deal with provider JWT tokens.
 //
-// Expired tokens are 403, "ExpiredProviderToken".
+// Requests without provider token are 403, "MissingProviderToken".
+//
+// Tokens issued more than an hour before the request was received
+// are 403, "ExpiredProviderToken".
 //
 // Tokens with incorrct signing algorithm are 403, "InvalidProviderToken".
 //
@@ -18,7 +21,10 @@ var AuthTokenHandlers []HadlerFunc
 func init() {
 	AuthTokenHandlers = []HadlerFunc{
 		func(req *APNSRequest) (int, string) {
-			if v, ok := req.TokenClaims["iat"]; !ok || int64(v.(float64)) < time.Now().Add(-1*time.Hour).Unix() {
+			if req.TokenClaims == nil {
+				return 403, "MissingProviderToken"
+			}
+			if v, ok := req.TokenClaims["iat"]; !ok || int64(v.(float64)) < req.Time.Add(-1*time.Hour).Unix() {
 				return 403, "ExpiredProviderToken"
 			}
 			if v, ok := req.TokenHeader["alg"]; !ok || v.(string) != "ES256" {
@@ -0,0 +1,131 @@
+// Copyright 2017 Aleksey Blinov. All rights reserved.
+
+package apns2mock
+
+import (
+	"sync"
+	"time"
+)
+
+// TokenUpdateLimits configure how often provider tokens can be changed.
+type TokenUpdateLimits struct {
+
+	// ConnInterval is the minimum amount of time a provider token must be
+	// in use on a connection before it can be replaced with another one.
+	// The limit is not enforced if ConnInterval is 0.
+	ConnInterval time.Duration
+
+	// TeamMax is the maximum number of distinct provider tokens of a single
+	// team that can be put to use within TeamWindow across all connections.
+	// The limit is not enforced if TeamMax is 0.
+	TeamMax int
+
+	// TeamWindow is the length of the sliding time window for TeamMax.
+	TeamWindow time.Duration
+}
+
+// DefaultTokenUpdateLimits emulate APNS allowing provider tokens
+// to be updated no more than once every 20 minutes.
+var DefaultTokenUpdateLimits = TokenUpdateLimits{
+	ConnInterval: 20 * time.Minute,
+}
+
+// NewTokenUpdateHandlers returns case handlers that keep track of
+// provider tokens used on each connection and by each team.
+// Requests changing provider token more often than the limits allow
+// are 429, "TooManyProviderTokenUpdates". Rejected tokens are not
+// considered to be in use.
+//
+// Requests without provider tokens are not evaluated. ConnInterval
+// is only enforced for requests served by Server, and the state of
+// each connection is discarded once it is closed. Returned case handlers
+// keep their own state and should not be shared between unrelated servers.
+func NewTokenUpdateHandlers(limits TokenUpdateLimits) []HadlerFunc {
+	tt := &tokenTracker{
+		limits: limits,
+		conns:  map[uint64]tokenUse{},
+		teams:  map[string][]tokenUse{},
+	}
+	return []HadlerFunc{
+		func(req *APNSRequest) (int, string) {
+			if req.TokenClaims == nil {
+				return 0, ""
+			}
+			team := stringValue(req.TokenClaims, "iss")
+			if !tt.use(req.conn, team, req.ProviderToken, req.Time) {
+				return 429, "TooManyProviderTokenUpdates"
+			}
+			return 0, ""
+		},
+	}
+}
+
+// tokenUse records when a provider token was first put to use.
+type tokenUse struct {
+	token string
+	since time.Time
+}
+
+// tokenTracker keeps provider tokens in use on connections
+// and recently used tokens of each team.
+type tokenTracker struct {
+	limits TokenUpdateLimits
+
+	mu    sync.Mutex
+	conns map[uint64]tokenUse
+	teams map[string][]tokenUse
+}
+
+// use records that the token is used by team on connection conn
+// at time now unless this exceeds the limits, in which case it returns
+// false. Connection is not tracked if conn is nil.
+func (tt *tokenTracker) use(conn *netConn, team, token string, now time.Time) bool {
+	tt.mu.Lock()
+	defer tt.mu.Unlock()
+	var cu tokenUse
+	hasConn := false
+	if conn != nil {
+		cu, hasConn = tt.conns[conn.id]
+	}
+	if hasConn && cu.token == token {
+		return true
+	}
+	if hasConn && tt.limits.ConnInterval > 0 && now.Sub(cu.since) < tt.limits.ConnInterval {
+		return false
+	}
+	tus := tt.teams[team]
+	i := 0
+	for i < len(tus) && now.Sub(tus[i].since) >= tt.limits.TeamWindow {
+		i++
+	}
+	tus = tus[i:]
+	isNew := true
+	for _, tu := range tus {
+		if tu.token == token {
+			isNew = false
+			break
+		}
+	}
+	if isNew && tt.limits.TeamMax > 0 && len(tus) >= tt.limits.TeamMax {
+		tt.teams[team] = tus
+		return false
+	}
+	if isNew {
+		tus = append(tus, tokenUse{token, now})
+	}
+	tt.teams[team] = tus
+	if conn == nil {
+		return true
+	}
+	if hasConn || conn.whenClosed(func() { tt.forget(conn.id) }) {
+		tt.conns[conn.id] = tokenUse{token, now}
+	}
+	return true
+}
+
+// forget discards provider token in use on connection with the specified ID.
+func (tt *tokenTracker) forget(id uint64) {
+	tt.mu.Lock()
+	defer tt.mu.Unlock()
+	delete(tt.conns, id)
+}
@@ -12,6 +12,10 @@ var CertAuthHandler *CaseHandler
 // client certificate-based requests.
 var DefaultHandler *CaseHandler
 
+// AuthHandlers authenticate requests with provider tokens using
+// AuthTokenHandlers and requests without provider tokens using CertHandlers.
+var AuthHandlers []HadlerFunc
+
 // JoinHandlers is a convenience function that joins all supplied handlers
 // and returns the combine slice.
 func JoinHandlers(hs ...[]HadlerFunc) []HadlerFunc {
@@ -22,16 +26,35 @@ func JoinHandlers(hs ...[]HadlerFunc) []HadlerFunc {
 	return res
 }
 
+// NewAuthHandlers returns case handlers that evaluate requests carrying
+// JWT provider tokens with tokenHandlers and all other requests
+// with certHandlers.
+func NewAuthHandlers(tokenHandlers, certHandlers []HadlerFunc) []HadlerFunc {
+	return []HadlerFunc{
+		func(req *APNSRequest) (int, string) {
+			hs := certHandlers
+			if req.TokenClaims != nil {
+				hs = tokenHandlers
+			}
+			for _, h := range hs {
+				if status, reason := h(req); status > 0 {
+					return status, reason
+				}
+			}
+			return 0, ""
+		},
+	}
+}
+
 func init() {
 	TokenAuthHandler = &CaseHandler{
-		CaseHandlers: JoinHandlers(HeaderHandlers, DeviceTokenHandlers, AuthTokenHandlers),
+		CaseHandlers: JoinHandlers(HeaderHandlers, PushTypeHandlers, DeviceTokenHandlers, AuthTokenHandlers),
 	}
-	// TODO Implement and add CertHandlers.
 	CertAuthHandler = &CaseHandler{
-		CaseHandlers: JoinHandlers(HeaderHandlers, DeviceTokenHandlers),
+		CaseHandlers: JoinHandlers(HeaderHandlers, PushTypeHandlers, DeviceTokenHandlers, CertHandlers),
 	}
-	// TODO Implement and add CertHandlers and combination handlers.
+	AuthHandlers = NewAuthHandlers(AuthTokenHandlers, CertHandlers)
 	DefaultHandler = &CaseHandler{
-		CaseHandlers: JoinHandlers(HeaderHandlers, DeviceTokenHandlers, AuthTokenHandlers),
+		CaseHandlers: JoinHandlers(HeaderHandlers, PushTypeHandlers, DeviceTokenHandlers, AuthHandlers),
 	}
 }
@@ -0,0 +1,149 @@
+// Copyright 2017 Aleksey Blinov. All rights reserved.
+
+package apns2mock
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Clock is the source of current time for Server and case handlers.
+// It is used for checking provider token expiration, notification
+// expiration, running schedules and reporting unregistration timestamps.
+//
+// Clock does not affect connection and response delays, which are
+// always measured in real time.
+type Clock interface {
+
+	// Now returns current time.
+	Now() time.Time
+
+	// After waits for duration d to elapse and then sends current time
+	// on the returned channel.
+	After(d time.Duration) <-chan time.Time
+}
+
+// SystemClock is Clock reporting real time.
+var SystemClock Clock = systemClock{}
+
+type systemClock struct{}
+
+func (c systemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (c systemClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+// FakeClock is Clock that only moves when told to. It is typically used
+// for testing time-dependent behavior, such as provider token expiration,
+// without having to wait.
+type FakeClock struct {
+	mu      sync.Mutex
+	now     time.Time
+	waiters []fakeWaiter
+
+	// changed is closed and reset whenever a waiter is added.
+	changed chan struct{}
+}
+
+type fakeWaiter struct {
+	at time.Time
+	ch chan time.Time
+}
+
+// NewFakeClock returns a new FakeClock set to time now.
+func NewFakeClock(now time.Time) *FakeClock {
+	return &FakeClock{now: now}
+}
+
+// Now returns current time of the clock.
+func (c *FakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// After returns a channel on which current time of the clock is sent
+// once the clock is advanced by d or more.
+func (c *FakeClock) After(d time.Duration) <-chan time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ch := make(chan time.Time, 1)
+	if d <= 0 {
+		ch <- c.now
+		return ch
+	}
+	c.waiters = append(c.waiters, fakeWaiter{at: c.now.Add(d), ch: ch})
+	if c.changed != nil {
+		close(c.changed)
+		c.changed = nil
+	}
+	return ch
+}
+
+// WaitForWaiters blocks until at least n channels returned by After
+// are waiting for the clock to be advanced or until timeout expires,
+// in which case it returns an error. Tests use it to make sure that
+// the goroutines they expect to be woken up by Advance or Set
+// are already waiting.
+func (c *FakeClock) WaitForWaiters(n int, timeout time.Duration) error {
+	deadline := time.After(timeout)
+	for {
+		c.mu.Lock()
+		cnt := len(c.waiters)
+		if cnt >= n {
+			c.mu.Unlock()
+			return nil
+		}
+		if c.changed == nil {
+			c.changed = make(chan struct{})
+		}
+		ch := c.changed
+		c.mu.Unlock()
+		select {
+		case <-ch:
+		case <-deadline:
+			return fmt.Errorf("apns2mock: timed out after %v waiting for %v clock waiters, found %v", timeout, n, cnt)
+		}
+	}
+}
+
+// Advance moves the clock forward by d.
+func (c *FakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.set(c.now.Add(d))
+}
+
+// Set sets the clock to time t.
+func (c *FakeClock) Set(t time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.set(t)
+}
+
+func (c *FakeClock) set(t time.Time) {
+	c.now = t
+	ws := c.waiters[:0]
+	for _, w := range c.waiters {
+		if w.at.After(t) {
+			ws = append(ws, w)
+			continue
+		}
+		w.ch <- t
+	}
+	c.waiters = ws
+}
+
+// requestClock returns clock of the server serving request r
+// or SystemClock if r is not served by Server.
+func requestClock(r *http.Request) Clock {
+	if env := requestEnvOf(r); env != nil {
+		return env.clock
+	}
+	return SystemClock
+}
@@ -0,0 +1,103 @@
+// Copyright 2017 Aleksey Blinov. All rights reserved.
+
+package apns2mock
+
+import (
+	"sort"
+	"time"
+)
+
+// ConnInfo describes a client connection open on Server.
+type ConnInfo struct {
+
+	// ID identifies the connection. It matches Notification.ConnID
+	// of notifications received on the connection.
+	ID uint64 `json:"id"`
+
+	// RemoteAddr is the network address of the client.
+	RemoteAddr string `json:"remote_addr"`
+
+	// Accepted is the time the connection was accepted at
+	// as reported by server's clock.
+	Accepted time.Time `json:"accepted"`
+
+	// Streams is the number of notification requests served
+	// on the connection.
+	Streams uint64 `json:"streams"`
+
+	// ActiveStreams is the number of notification requests
+	// currently being served on the connection.
+	ActiveStreams int `json:"active_streams"`
+
+	// TLSVersion and CipherSuite are negotiated TLS parameters
+	// as defined in crypto/tls. They are 0 until TLS handshake
+	// is complete.
+	TLSVersion  uint16 `json:"tls_version"`
+	CipherSuite uint16 `json:"cipher_suite"`
+
+	// Team and Key are team ID and key ID of the JWT provider token
+	// last seen on the connection, or empty strings if none was seen.
+	Team string `json:"team,omitempty"`
+	Key  string `json:"key,omitempty"`
+}
+
+// Connections returns details of currently open client connections
+// ordered by their IDs.
+func (s *Server) Connections() []ConnInfo {
+	l := s.listener
+	l.mu.Lock()
+	res := make([]ConnInfo, 0, len(l.conns))
+	h2s := make([]*h2Conn, 0, len(l.conns))
+	for _, c := range l.conns {
+		res = append(res, ConnInfo{
+			ID:            c.id,
+			RemoteAddr:    c.addr,
+			Accepted:      c.accepted,
+			Streams:       c.served,
+			ActiveStreams: c.active,
+			Team:          c.team,
+			Key:           c.key,
+		})
+		h2s = append(h2s, c.h2)
+	}
+	l.mu.Unlock()
+	// Connection state is read outside of listener's lock as TLS
+	// connection has locks of its own.
+	for i, h2 := range h2s {
+		if h2 == nil {
+			continue
+		}
+		cs := h2.ConnectionState()
+		res[i].TLSVersion = cs.Version
+		res[i].CipherSuite = cs.CipherSuite
+	}
+	sort.Sort(connsByID(res))
+	return res
+}
+
+type connsByID []ConnInfo
+
+func (a connsByID) Len() int           { return len(a) }
+func (a connsByID) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a connsByID) Less(i, j int) bool { return a[i].ID < a[j].ID }
+
+// begin registers start of notification request on the connection.
+func (c *netConn) begin() {
+	c.l.mu.Lock()
+	defer c.l.mu.Unlock()
+	c.active++
+}
+
+// end registers completion of notification request n on the connection.
+func (c *netConn) end(n *Notification) {
+	c.l.mu.Lock()
+	defer c.l.mu.Unlock()
+	c.active--
+	c.served++
+	if team := stringValue(n.TokenClaims, "iss"); team != "" {
+		c.team = team
+	}
+	if key := stringValue(n.TokenHeader, "kid"); key != "" {
+		c.key = key
+	}
+}
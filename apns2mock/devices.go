@@ -0,0 +1,159 @@
+// Copyright 2017 Aleksey Blinov. All rights reserved.
+
+package apns2mock
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DeviceState describes whether a device token is valid for delivery.
+type DeviceState string
+
+const (
+	// DeviceActive marks device tokens that notifications can be delivered to.
+	DeviceActive DeviceState = "active"
+
+	// DeviceUnregistered marks device tokens that are no longer valid
+	// for the topic, e.g. because the app was uninstalled.
+	DeviceUnregistered DeviceState = "unregistered"
+)
+
+// Device describes a device token known to DeviceRegistry.
+type Device struct {
+
+	// Token is hexadecimal device token.
+	Token string `json:"token"`
+
+	// Topic is the bundle ID of the app the token was issued to.
+	// Topics of VoIP, complication and other pushes derived from
+	// the bundle ID are accepted as well. If empty, any topic is accepted.
+	Topic string `json:"topic,omitempty"`
+
+	// Environment is the APNS environment the token was issued for.
+	// AnyEnvironment token is valid in both environments.
+	Environment Environment `json:"environment,omitempty"`
+
+	// State is the current state of the device token. Empty state
+	// is the same as DeviceActive.
+	State DeviceState `json:"state,omitempty"`
+
+	// UnregisteredAt is the time at which the device token became invalid
+	// for the topic. It is reported in 410 responses for unregistered devices.
+	UnregisteredAt time.Time `json:"unregistered_at"`
+}
+
+// DeviceRegistry is a collection of known device tokens. It can be used
+// with NewDeviceHandlers to drive request outcomes from device data instead
+// of predefined token patterns of DeviceTokenHandlers.
+//
+// DeviceRegistry is safe for concurrent use.
+type DeviceRegistry struct {
+	mu      sync.RWMutex
+	devices map[string]Device
+}
+
+// NewDeviceRegistry creates a new registry containing specified devices.
+func NewDeviceRegistry(devices ...Device) *DeviceRegistry {
+	res := &DeviceRegistry{devices: map[string]Device{}}
+	for _, d := range devices {
+		res.Add(d)
+	}
+	return res
+}
+
+// LoadDeviceRegistry creates a new registry with devices loaded from
+// the specified JSON file. The file must contain an array of objects
+// with the fields of Device, e.g.:
+//
+//	[
+//	  {"token": "a1b2...", "topic": "com.example.app", "environment": "sandbox"},
+//	  {"token": "c3d4...", "topic": "com.example.app", "state": "unregistered",
+//	   "unregistered_at": "2017-06-01T12:00:00Z"}
+//	]
+func LoadDeviceRegistry(path string) (*DeviceRegistry, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var devices []Device
+	if err := json.Unmarshal(b, &devices); err != nil {
+		return nil, err
+	}
+	return NewDeviceRegistry(devices...), nil
+}
+
+// Add adds device to the registry replacing any device
+// with the same token.
+func (r *DeviceRegistry) Add(d Device) {
+	d.Token = strings.ToLower(d.Token)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.devices[d.Token] = d
+}
+
+// Remove removes device with the specified token from the registry.
+func (r *DeviceRegistry) Remove(token string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.devices, strings.ToLower(token))
+}
+
+// Unregister marks device with the specified token as unregistered
+// at the specified time. It returns false if the device is not known.
+func (r *DeviceRegistry) Unregister(token string, at time.Time) bool {
+	token = strings.ToLower(token)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	d, ok := r.devices[token]
+	if ok {
+		d.State = DeviceUnregistered
+		d.UnregisteredAt = at
+		r.devices[token] = d
+	}
+	return ok
+}
+
+// Device returns device with the specified token.
+func (r *DeviceRegistry) Device(token string) (Device, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	d, ok := r.devices[strings.ToLower(token)]
+	return d, ok
+}
+
+// Devices returns all devices in the registry ordered by token.
+func (r *DeviceRegistry) Devices() []Device {
+	r.mu.RLock()
+	res := make([]Device, 0, len(r.devices))
+	for _, d := range r.devices {
+		res = append(res, d)
+	}
+	r.mu.RUnlock()
+	sort.Sort(byToken(res))
+	return res
+}
+
+type byToken []Device
+
+func (s byToken) Len() int           { return len(s) }
+func (s byToken) Less(i, j int) bool { return s[i].Token < s[j].Token }
+func (s byToken) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+// acceptsTopic reports whether notifications for topic
+// can be delivered to the device.
+func (d *Device) acceptsTopic(topic string) bool {
+	if d.Topic == "" || topic == d.Topic {
+		return true
+	}
+	for _, suffix := range PushTypes {
+		if suffix != "" && topic == d.Topic+suffix {
+			return true
+		}
+	}
+	return false
+}
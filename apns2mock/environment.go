@@ -0,0 +1,80 @@
+// Copyright 2017 Aleksey Blinov. All rights reserved.
+
+package apns2mock
+
+// EnvironmentPair is a pair of servers emulating APNS development
+// and production environments. Both servers evaluate device tokens
+// against the same DeviceRegistry, so that tokens issued for one
+// environment are rejected by the other server with 400, "BadDeviceToken",
+// just like they are by actual APNS.
+type EnvironmentPair struct {
+
+	// Sandbox is the server emulating development environment.
+	Sandbox *Server
+
+	// Production is the server emulating production environment.
+	Production *Server
+
+	// Registry is the device registry shared by both servers.
+	Registry *DeviceRegistry
+}
+
+// NewEnvironmentPair creates and starts sandbox and production servers
+// sharing registry. If registry is nil, a new empty registry is created.
+//
+// Both servers handle requests like DefaultHandler, except that device
+// tokens are evaluated by NewDeviceHandlers and client certificates
+// by NewCertHandlers with nil roots for server's environment.
+// Case handlers in hs, if any, are evaluated ahead of all other rules.
+// Servers are started with auto-generated certificates.
+func NewEnvironmentPair(commsCfg CommsCfg, registry *DeviceRegistry, hs ...[]HadlerFunc) (*EnvironmentPair, error) {
+	if registry == nil {
+		registry = NewDeviceRegistry()
+	}
+	res := &EnvironmentPair{Registry: registry}
+	var err error
+	if res.Sandbox, err = newEnvironmentServer(commsCfg, registry, Sandbox, hs); err != nil {
+		return nil, err
+	}
+	if res.Production, err = newEnvironmentServer(commsCfg, registry, Production, hs); err != nil {
+		res.Sandbox.Close()
+		return nil, err
+	}
+	return res, nil
+}
+
+func newEnvironmentServer(commsCfg CommsCfg, registry *DeviceRegistry, env Environment, hs [][]HadlerFunc) (*Server, error) {
+	handler := &CaseHandler{
+		CaseHandlers: JoinHandlers(
+			JoinHandlers(hs...),
+			HeaderHandlers,
+			PushTypeHandlers,
+			NewDeviceHandlers(registry, env),
+			NewAuthHandlers(AuthTokenHandlers, NewCertHandlers(nil, env)),
+		),
+	}
+	res, err := NewServer(commsCfg, handler, AutoCert, AutoKey)
+	if err != nil {
+		return nil, err
+	}
+	res.env = env
+	return res, nil
+}
+
+// Server returns the server emulating env, or nil if env
+// is AnyEnvironment.
+func (p *EnvironmentPair) Server(env Environment) *Server {
+	switch env {
+	case Sandbox:
+		return p.Sandbox
+	case Production:
+		return p.Production
+	}
+	return nil
+}
+
+// Close closes both servers.
+func (p *EnvironmentPair) Close() {
+	p.Sandbox.Close()
+	p.Production.Close()
+}
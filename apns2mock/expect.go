@@ -0,0 +1,225 @@
+// Copyright 2017 Aleksey Blinov. All rights reserved.
+
+package apns2mock
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// TestingT is the subset of testing.TB used by Server.Verify.
+type TestingT interface {
+	Errorf(format string, args ...interface{})
+}
+
+// Expectation describes requests the server is expected to receive.
+// Expectations are created with Server.Expect and configured by chaining
+// calls to their methods, e.g.:
+//
+//	s.Expect().DeviceToken(token).Topic("com.example.app").Times(2).Respond(410, "Unregistered")
+//
+// Requests are matched against expectations in the order the expectations
+// were created. A matching request is responded to as configured by Respond
+// or, if Respond was not called, passed to server's handler. Once an
+// expectation is matched by as many requests as specified by Times,
+// it no longer matches further requests. Requests responded to
+// by the server itself, e.g. while it is unavailable or with responses
+// set by SetTokenResponse, do not match any expectations.
+type Expectation struct {
+	set *expectations
+
+	matchers []func(n *Notification) bool
+	desc     []string
+
+	// times is the expected number of matching requests,
+	// or -1 for any number of requests.
+	times int
+	count int
+
+	respond bool
+	status  int
+	reason  string
+}
+
+// expectations holds server's expectations and requests
+// that did not match any of them.
+type expectations struct {
+	mu         sync.Mutex
+	list       []*Expectation
+	unexpected []Notification
+}
+
+// Expect creates a new expectation that matches any request once.
+// Use Expectation's methods to narrow it down.
+func (s *Server) Expect() *Expectation {
+	res := &Expectation{set: s.expectations, times: 1}
+	s.expectations.mu.Lock()
+	defer s.expectations.mu.Unlock()
+	s.expectations.list = append(s.expectations.list, res)
+	return res
+}
+
+// Verify reports unmet expectations and requests that did not match
+// any expectation as errors to t. Requests received while no expectations
+// are set are not considered unexpected. It returns true if all expectations
+// have been met and no unexpected requests have been received.
+func (s *Server) Verify(t TestingT) bool {
+	if h, ok := t.(interface {
+		Helper()
+	}); ok {
+		h.Helper()
+	}
+	s.expectations.mu.Lock()
+	defer s.expectations.mu.Unlock()
+	res := true
+	for _, e := range s.expectations.list {
+		if e.times >= 0 && e.count != e.times {
+			t.Errorf("apns2mock: unmet expectation for request with %v: expected %v, received %v", e.String(), e.times, e.count)
+			res = false
+		}
+	}
+	for _, n := range s.expectations.unexpected {
+		t.Errorf("apns2mock: unexpected request for device token %#v with topic %#v", n.DeviceToken, n.Header.Get("apns-topic"))
+		res = false
+	}
+	return res
+}
+
+// ClearExpectations removes all expectations and forgets all unexpected
+// requests received so far.
+func (s *Server) ClearExpectations() {
+	s.expectations.mu.Lock()
+	defer s.expectations.mu.Unlock()
+	s.expectations.list = nil
+	s.expectations.unexpected = nil
+}
+
+// match finds the first expectation matching notification n and counts
+// the match. It returns nil if no expectation matches n, in which case
+// n is remembered as unexpected while there are any expectations set.
+func (es *expectations) match(n *Notification) *Expectation {
+	es.mu.Lock()
+	defer es.mu.Unlock()
+	if len(es.list) == 0 {
+		return nil
+	}
+	for _, e := range es.list {
+		if e.times >= 0 && e.count >= e.times {
+			continue
+		}
+		if e.matches(n) {
+			e.count++
+			return e
+		}
+	}
+	es.unexpected = append(es.unexpected, *n)
+	return nil
+}
+
+func (e *Expectation) matches(n *Notification) bool {
+	for _, m := range e.matchers {
+		if !m(n) {
+			return false
+		}
+	}
+	return true
+}
+
+func (e *Expectation) add(desc string, m func(n *Notification) bool) *Expectation {
+	e.set.mu.Lock()
+	defer e.set.mu.Unlock()
+	e.matchers = append(e.matchers, m)
+	e.desc = append(e.desc, desc)
+	return e
+}
+
+// DeviceToken restricts expectation to requests for the specified device token.
+func (e *Expectation) DeviceToken(token string) *Expectation {
+	return e.add(fmt.Sprintf("device token %#v", token), func(n *Notification) bool {
+		return strings.EqualFold(n.DeviceToken, token)
+	})
+}
+
+// Topic restricts expectation to requests with the specified apns-topic.
+func (e *Expectation) Topic(topic string) *Expectation {
+	return e.Header("apns-topic", topic)
+}
+
+// PushType restricts expectation to requests with the specified apns-push-type.
+func (e *Expectation) PushType(pushType string) *Expectation {
+	return e.Header("apns-push-type", pushType)
+}
+
+// Priority restricts expectation to requests with the specified apns-priority.
+func (e *Expectation) Priority(priority string) *Expectation {
+	return e.Header("apns-priority", priority)
+}
+
+// Header restricts expectation to requests with the specified header value.
+func (e *Expectation) Header(name, value string) *Expectation {
+	return e.add(fmt.Sprintf("%v %#v", strings.ToLower(name), value), func(n *Notification) bool {
+		return n.Header.Get(name) == value
+	})
+}
+
+// Match restricts expectation to requests for which f returns true.
+// Response details of notifications passed to f are not yet set.
+func (e *Expectation) Match(f func(n Notification) bool) *Expectation {
+	return e.add("custom match", func(n *Notification) bool {
+		return f(*n)
+	})
+}
+
+// Times sets the number of requests the expectation should match.
+func (e *Expectation) Times(n int) *Expectation {
+	e.set.mu.Lock()
+	defer e.set.mu.Unlock()
+	e.times = n
+	return e
+}
+
+// AnyTimes allows the expectation to match any number of requests,
+// including none.
+func (e *Expectation) AnyTimes() *Expectation {
+	return e.Times(-1)
+}
+
+// Respond makes server respond to matching requests with the specified status
+// code and rejection reason instead of passing them to server's handler.
+// Use status 200 and empty reason for successful responses.
+func (e *Expectation) Respond(status int, reason string) *Expectation {
+	e.set.mu.Lock()
+	defer e.set.mu.Unlock()
+	e.respond = true
+	e.status = status
+	e.reason = reason
+	return e
+}
+
+// String returns human-readable description of the expectation.
+func (e *Expectation) String() string {
+	if len(e.desc) == 0 {
+		return "any attributes"
+	}
+	return strings.Join(e.desc, ", ")
+}
+
+// serve responds to request matching the expectation.
+// It returns false if the request should be passed to server's handler.
+func (e *Expectation) serve(w http.ResponseWriter, r *http.Request) bool {
+	e.set.mu.Lock()
+	respond, status, reason := e.respond, e.status, e.reason
+	e.set.mu.Unlock()
+	if !respond {
+		return false
+	}
+	writeApnsId(w, r)
+	if status == 200 {
+		respSucc(w)
+	} else {
+		respErr(w, status, reason)
+	}
+	return true
+}
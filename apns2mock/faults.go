@@ -0,0 +1,84 @@
+// Copyright 2017 Aleksey Blinov. All rights reserved.
+
+package apns2mock
+
+import (
+	"errors"
+	"math/rand"
+	"net/http"
+	"sync"
+)
+
+// Fault describes a rejection response sent to a percentage of requests.
+type Fault struct {
+
+	// Percent is the percentage of requests that are rejected, e.g. 0.5
+	// for one in two hundred requests.
+	Percent float64 `json:"percent"`
+
+	// Status is the response status code. It must be between 400 and 599.
+	Status int `json:"status"`
+
+	// Reason is the rejection reason reported in the response.
+	Reason string `json:"reason"`
+}
+
+// FaultProfile describes randomly occurring faults.
+//
+//	apns2mock.FaultProfile{
+//		Seed: 42,
+//		Faults: []apns2mock.Fault{
+//			{2, 500, "InternalServerError"},
+//			{1, 503, "ServiceUnavailable"},
+//			{0.5, 429, "TooManyRequests"},
+//		},
+//	}
+type FaultProfile struct {
+
+	// Faults lists possible faults. Their percentages must not add up
+	// to more than 100.
+	Faults []Fault `json:"faults"`
+
+	// Seed initializes the random number generator deciding which requests
+	// are rejected. Profiles with the same seed reject the same requests
+	// when requests arrive in the same order. Use time.Now().UnixNano()
+	// for non-reproducible behavior.
+	Seed int64 `json:"seed"`
+}
+
+// SetFaultProfile makes server randomly reject future requests as described
+// by the profile. Requests that are not rejected are handled normally.
+// Fault profile replaces unavailability set with BecomeUnavailable and
+// is removed by BecomeAvailable.
+func (s *Server) SetFaultProfile(p FaultProfile) error {
+	total := 0.0
+	for _, f := range p.Faults {
+		if f.Percent < 0 {
+			return errors.New("apns2mock: negative fault percentage")
+		}
+		if f.Status < 400 || f.Status > 599 {
+			return errors.New("apns2mock: fault status must be between 400 and 599")
+		}
+		total += f.Percent
+	}
+	if total > 100 {
+		return errors.New("apns2mock: fault percentages add up to more than 100")
+	}
+	faults := append([]Fault{}, p.Faults...)
+	rnd := rand.New(rand.NewSource(p.Seed))
+	var mu sync.Mutex
+	s.interceptor.Store(func(w http.ResponseWriter, r *http.Request) bool {
+		mu.Lock()
+		v := rnd.Float64() * 100
+		mu.Unlock()
+		for _, f := range faults {
+			if v < f.Percent {
+				respErr(w, f.Status, f.Reason)
+				return true
+			}
+			v -= f.Percent
+		}
+		return false
+	})
+	return nil
+}
@@ -0,0 +1,358 @@
+// Copyright 2017 Aleksey Blinov. All rights reserved.
+
+package apns2mock
+
+import (
+	"bytes"
+	"crypto/tls"
+	"log"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+// h2Conn wraps TLS connection served by http2.Server. It follows HTTP/2
+// frames flowing in both directions so that frames can be injected
+// into server's output without corrupting it. This makes it possible
+// to emulate APNS behavior that http2.Server has no API for,
+// such as sending GOAWAY frames on demand.
+type h2Conn struct {
+	*tls.Conn
+
+	// nc is the underlying connection accepted by server's listener.
+	nc *netConn
+
+	// goAwayAfterStreams, if not 0, is the number of streams after
+	// which GOAWAY is sent.
+	goAwayAfterStreams uint32
+
+	// ageTimer sends GOAWAY once connection reaches configured age.
+	ageTimer *time.Timer
+
+	// rmu guards read side state.
+	rmu         sync.Mutex
+	in          frameScanner
+	maxStreamID uint32
+	streams     uint32
+
+	// wmu guards write side state and serializes writes.
+	wmu     sync.Mutex
+	out     frameScanner
+	pending [][]byte
+
+	// resetCodes are error codes to put into RST_STREAM frames
+	// sent by the server in place of their own, keyed by stream ID.
+	resetCodes map[uint32]http2.ErrCode
+
+	// rst is the error code being written over the payload
+	// of current RST_STREAM frame.
+	rst []byte
+
+	// settings override parameters of server's initial SETTINGS frame.
+	// The frame is held in preface until it is complete.
+	settings []http2.Setting
+	preface  []byte
+}
+
+// newH2Conn wraps TLS connection c. GOAWAY is sent once the client
+// opens commsCfg.GoAwayAfterStreams streams or once the connection
+// is commsCfg.GoAwayAfterAge old, whichever comes first.
+// Parameters advertised in server's initial SETTINGS frame are
+// overridden as specified by commsCfg.HTTP2.
+func (l *cappedConnListener) newH2Conn(c *tls.Conn, commsCfg CommsCfg) *h2Conn {
+	res := &h2Conn{
+		Conn:               c,
+		in:                 frameScanner{skip: len(http2.ClientPreface)},
+		goAwayAfterStreams: commsCfg.GoAwayAfterStreams,
+		settings:           commsCfg.HTTP2.advertised(),
+	}
+	if commsCfg.GoAwayAfterAge > 0 {
+		res.ageTimer = time.AfterFunc(commsCfg.GoAwayAfterAge, func() {
+			res.sendGoAway(http2.ErrCodeNo, nil)
+		})
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if nc := l.conns[c.RemoteAddr().String()]; nc != nil {
+		nc.h2 = res
+		res.nc = nc
+	}
+	return res
+}
+
+func (c *h2Conn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		c.rmu.Lock()
+		goAway := false
+		for p := b[:n]; len(p) > 0; {
+			p = p[c.in.next(p, func(h frameHeader) {
+				// Client initiated streams have odd IDs and start with HEADERS.
+				if h.Type != http2.FrameHeaders || h.StreamID%2 == 0 || h.StreamID <= c.maxStreamID {
+					return
+				}
+				c.maxStreamID = h.StreamID
+				c.streams++
+				if c.streams == c.goAwayAfterStreams {
+					goAway = true
+				}
+			}):]
+		}
+		c.rmu.Unlock()
+		if goAway {
+			// Writing may block, so it must not be done on server's
+			// read loop.
+			go c.sendGoAway(http2.ErrCodeNo, nil)
+		}
+	}
+	return n, err
+}
+
+func (c *h2Conn) Write(b []byte) (int, error) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	res := 0
+	for len(b) > 0 {
+		k := c.out.next(b, func(h frameHeader) {
+			if h.Type != http2.FrameRSTStream || h.Length != 4 {
+				return
+			}
+			if code, ok := c.resetCodes[h.StreamID]; ok {
+				delete(c.resetCodes, h.StreamID)
+				c.rst = []byte{byte(code >> 24), byte(code >> 16), byte(code >> 8), byte(code)}
+			}
+		})
+		chunk := b[:k]
+		if len(c.rst) > 0 && c.out.payload > 0 {
+			chunk = append([]byte{}, chunk...)
+			p := chunk[k-c.out.payload:]
+			m := copy(p, c.rst)
+			c.rst = c.rst[m:]
+		}
+		b = b[k:]
+		if len(c.settings) > 0 {
+			// Server's initial SETTINGS frame is the very first frame
+			// it writes.
+			c.preface = append(c.preface, chunk...)
+			res += k
+			if !c.out.atBoundary() {
+				continue
+			}
+			chunk = rewriteSettings(c.preface, c.settings)
+			c.settings, c.preface = nil, nil
+			if _, err := c.Conn.Write(chunk); err != nil {
+				return res, err
+			}
+		} else {
+			n, err := c.Conn.Write(chunk)
+			res += n
+			if err != nil {
+				return res, err
+			}
+		}
+		if err := c.flushPending(); err != nil {
+			return res, err
+		}
+	}
+	return res, nil
+}
+
+func (c *h2Conn) Close() error {
+	if c.ageTimer != nil {
+		c.ageTimer.Stop()
+	}
+	return c.Conn.Close()
+}
+
+// rewriteReset makes RST_STREAM frame sent by the server for stream
+// with the specified ID carry the specified error code instead of its own.
+func (c *h2Conn) rewriteReset(streamID uint32, code http2.ErrCode) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if c.resetCodes == nil {
+		c.resetCodes = map[uint32]http2.ErrCode{}
+	}
+	c.resetCodes[streamID] = code
+}
+
+// h2StreamIDWarning makes sure failure to find stream IDs is logged once.
+var h2StreamIDWarning sync.Once
+
+// h2StreamID returns ID of the stream served by response writer w
+// of http2.Server, or 0 if w is not one. http2.Server has no API
+// for this, so the ID is looked up in w's unexported state.
+// Failure to find it in a response writer of http2.Server is logged.
+func h2StreamID(w http.ResponseWriter) uint32 {
+	t := reflect.TypeOf(w)
+	if t.Kind() != reflect.Ptr || !strings.HasSuffix(t.Elem().PkgPath(), "golang.org/x/net/http2") {
+		return 0
+	}
+	id, ok := lookupH2StreamID(reflect.ValueOf(w))
+	if !ok {
+		h2StreamIDWarning.Do(func() {
+			log.Printf("apns2mock: cannot find HTTP/2 stream ID in %v; streams will be reset with INTERNAL_ERROR regardless of NetFault.ErrCode", t)
+		})
+	}
+	return id
+}
+
+// lookupH2StreamID follows rws.stream.id fields of http2.Server's
+// response writer v.
+func lookupH2StreamID(v reflect.Value) (uint32, bool) {
+	for _, name := range []string{"rws", "stream", "id"} {
+		if v.Kind() != reflect.Ptr || v.IsNil() || v.Elem().Kind() != reflect.Struct {
+			return 0, false
+		}
+		if v = v.Elem().FieldByName(name); !v.IsValid() {
+			return 0, false
+		}
+	}
+	if v.Kind() != reflect.Uint32 || v.Uint() == 0 {
+		return 0, false
+	}
+	return uint32(v.Uint()), true
+}
+
+// inject writes frame f at the next frame boundary of server's output.
+func (c *h2Conn) inject(f []byte) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	c.pending = append(c.pending, f)
+	return c.flushPending()
+}
+
+// flushPending writes injected frames if server's output is
+// at a frame boundary. It must be called with c.wmu held.
+func (c *h2Conn) flushPending() error {
+	if !c.out.atBoundary() {
+		return nil
+	}
+	for len(c.pending) > 0 {
+		if _, err := c.Conn.Write(c.pending[0]); err != nil {
+			return err
+		}
+		c.pending = c.pending[1:]
+	}
+	return nil
+}
+
+// sendGoAway sends GOAWAY frame with the specified error code and debug
+// data. The last stream ID reported is the highest ID of streams
+// opened by the client so far.
+func (c *h2Conn) sendGoAway(code http2.ErrCode, debugData []byte) error {
+	c.rmu.Lock()
+	last := c.maxStreamID
+	c.rmu.Unlock()
+	var buf bytes.Buffer
+	if err := http2.NewFramer(&buf, nil).WriteGoAway(last, code, debugData); err != nil {
+		return err
+	}
+	return c.inject(buf.Bytes())
+}
+
+// ConnectionState makes TLS connection state available to http2.Server.
+func (c *h2Conn) ConnectionState() tls.ConnectionState {
+	return c.Conn.ConnectionState()
+}
+
+// frameHeader is a decoded HTTP/2 frame header.
+type frameHeader struct {
+	Length   uint32
+	Type     http2.FrameType
+	Flags    http2.Flags
+	StreamID uint32
+}
+
+// frameScanner follows HTTP/2 frame boundaries in a byte stream.
+type frameScanner struct {
+	// skip is the number of bytes to skip before the first frame.
+	skip int
+
+	hdr  [9]byte
+	nhdr int
+
+	// remaining is the number of bytes remaining in current frame's payload.
+	remaining int
+
+	// payload is the number of payload bytes consumed by the last call
+	// to next. They are always at the end of consumed bytes.
+	payload int
+}
+
+// next consumes bytes of b up to the end of the current frame
+// and returns their number. Function f, if not nil, is called
+// for every frame header that is fully consumed.
+func (s *frameScanner) next(b []byte, f func(h frameHeader)) int {
+	s.payload = 0
+	if s.skip > 0 {
+		n := s.skip
+		if n > len(b) {
+			n = len(b)
+		}
+		s.skip -= n
+		return n
+	}
+	n := 0
+	if s.nhdr < len(s.hdr) {
+		n = copy(s.hdr[s.nhdr:], b)
+		s.nhdr += n
+		if s.nhdr < len(s.hdr) {
+			return n
+		}
+		h := frameHeader{
+			Length:   uint32(s.hdr[0])<<16 | uint32(s.hdr[1])<<8 | uint32(s.hdr[2]),
+			Type:     http2.FrameType(s.hdr[3]),
+			Flags:    http2.Flags(s.hdr[4]),
+			StreamID: (uint32(s.hdr[5])<<24 | uint32(s.hdr[6])<<16 | uint32(s.hdr[7])<<8 | uint32(s.hdr[8])) & (1<<31 - 1),
+		}
+		s.remaining = int(h.Length)
+		if f != nil {
+			f(h)
+		}
+	}
+	k := s.remaining
+	if k > len(b)-n {
+		k = len(b) - n
+	}
+	s.remaining -= k
+	s.payload = k
+	n += k
+	if s.remaining == 0 {
+		s.nhdr = 0
+	}
+	return n
+}
+
+// atBoundary reports whether the scanner is positioned
+// in between frames.
+func (s *frameScanner) atBoundary() bool {
+	return s.skip == 0 && s.nhdr == 0 && s.remaining == 0
+}
+
+// h2Conns returns wrapped HTTP/2 connections with the specified IDs,
+// or all wrapped connections if no IDs are specified.
+func (l *cappedConnListener) h2Conns(ids ...uint64) []*h2Conn {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	res := []*h2Conn{}
+	for _, nc := range l.conns {
+		if nc.h2 == nil {
+			continue
+		}
+		if len(ids) == 0 {
+			res = append(res, nc.h2)
+			continue
+		}
+		for _, id := range ids {
+			if nc.id == id {
+				res = append(res, nc.h2)
+				break
+			}
+		}
+	}
+	return res
+}
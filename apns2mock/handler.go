@@ -3,12 +3,15 @@
 package apns2mock
 
 import (
+	"crypto/x509"
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"regexp"
 	"strings"
+	"time"
 
 	jwt "github.com/dgrijalva/jwt-go"
 	"github.com/satori/go.uuid"
@@ -23,16 +26,75 @@ type APNSRequest struct {
 	// Header is http.Header of the original request.
 	Header http.Header
 
+	// RemoteAddr is the network address of the client. All requests
+	// received on the same connection share the same address.
+	RemoteAddr string
+
+	// ConnID identifies the connection the request was received on,
+	// or is 0 if the request is not served by Server. Unlike RemoteAddr,
+	// it is never reused by later connections.
+	ConnID uint64
+
+	// conn is the connection the request was received on, if known.
+	conn *netConn
+
+	// Time is the time the request was received at. Case handlers should
+	// use it instead of time.Now() so that their behavior can be controlled
+	// with Clock.
+	Time time.Time
+
+	// ProviderToken is the original JWT provider token as supplied
+	// in authorization header, or empty string if none was supplied.
+	ProviderToken string
+
 	// TokenHeader is parsed headers of JWT provider token.
 	TokenHeader map[string]interface{}
 
 	// TokenClaims is parsed claims of JWT provider token.
 	TokenClaims map[string]interface{}
 
-	// Payload is parsed request payload.
+	// Payload is parsed request payload. JSON values are unmarshalled
+	// as described in encoding/json documentation, so that "aps" dictionary
+	// is available as Payload["aps"].(map[string]interface{}).
 	Payload map[string]interface{}
+
+	// ClientCert is the leaf TLS client certificate presented by the client,
+	// or nil if the client did not present any.
+	ClientCert *x509.Certificate
+
+	// ClientCertChain contains all TLS client certificates presented
+	// by the client, leaf certificate first.
+	ClientCertChain []*x509.Certificate
+
+	// Timestamp can be set by case handlers returning 410 status
+	// to the time at which the device token stopped being valid
+	// for the topic. It is reported in the response body.
+	Timestamp time.Time
+
+	// NetFault can be set by case handlers returning non-zero status
+	// to fail the request with network fault instead of responding.
+	// Status and reason are then only used by HalfWrite fault.
+	NetFault NetFault
+
+	// Latency can be set by case handlers to make the response take time
+	// chosen by it instead of server's response time.
+	Latency Latency
 }
 
+// Environment identifies APNS service environment.
+type Environment string
+
+const (
+	// AnyEnvironment matches both sandbox and production environments.
+	AnyEnvironment Environment = ""
+
+	// Sandbox is APNS development environment.
+	Sandbox Environment = "sandbox"
+
+	// Production is APNS production environment.
+	Production Environment = "production"
+)
+
 type HadlerFunc func(req *APNSRequest) (statusCode int, rejectionReason string)
 
 // AllOkayHandler always respons with status 200 and a valid APN ID.
@@ -45,6 +107,14 @@ func (h allOkayHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	respSucc(w)
 }
 
+// DefaultPayloadLimits contains maximum payload sizes in bytes enforced by
+// APNS for different push types. The limit listed under empty push type
+// applies to all push types that are not listed explicitly.
+var DefaultPayloadLimits = map[string]int{
+	"":     4096,
+	"voip": 5120,
+}
+
 var (
 	regEx_DeviceToken = regexp.MustCompile("[[:xdigit:]]+")
 )
@@ -65,8 +135,28 @@ type CaseHandler struct {
 	// is selected and its rejection reason is sent in the response.
 	//
 	// If none of the case handlers return non-zero status code, as 200
-	// successful response is sent back to the client.
+	// successful response is sent back to the client. Case handler returning
+	// status 200 accepts the request without consulting the remaining
+	// case handlers.
 	CaseHandlers []HadlerFunc
+
+	// ProviderKeys, if not nil, is used to verify signatures of JWT provider
+	// tokens. Tokens signed with unknown keys or with keys registered
+	// to a team other than the one in token's "iss" claim, as well as
+	// tokens with invalid signatures are rejected with 403,
+	// "InvalidProviderToken" before case handlers are consulted.
+	//
+	// If ProviderKeys is nil, token signatures are not verified.
+	ProviderKeys *ProviderKeys
+
+	// PayloadLimits, if not nil, overrides maximum payload sizes for push
+	// types listed in it. Payloads over the limit are rejected with 413,
+	// "PayloadTooLarge". See DefaultPayloadLimits for more information.
+	PayloadLimits map[string]int
+
+	// Clock, if not nil, is the source of APNSRequest.Time. Otherwise
+	// the clock of the Server serving the request is used.
+	Clock Clock
 }
 
 // ServeHTTP serves all incoming HTTP requests. It performs initial
@@ -82,53 +172,116 @@ func (h *CaseHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		h.respErr(w, 400, "BadDeviceToken")
 		return
 	}
-	ah := r.Header.Get("authorization")
-	if !strings.HasPrefix(ah, "bearer ") {
-		h.respErr(w, 403, "MissingProviderToken")
+	var cc []*x509.Certificate
+	if r.TLS != nil {
+		cc = r.TLS.PeerCertificates
+	}
+	var pt string
+	var th, tc map[string]interface{}
+	// Requests from clients authenticated with TLS certificates
+	// need not carry a provider token.
+	if ah := r.Header.Get("authorization"); ah != "" || len(cc) == 0 {
+		var reason string
+		if pt, th, tc, reason = parseProviderToken(ah); reason != "" {
+			h.respErr(w, 403, reason)
+			return
+		}
+		if h.ProviderKeys != nil && !h.ProviderKeys.verify(pt, th, tc) {
+			h.respErr(w, 403, "InvalidProviderToken")
+			return
+		}
+	}
+	limit := h.payloadLimit(r.Header.Get("apns-push-type"))
+	bb, err := ioutil.ReadAll(io.LimitReader(r.Body, int64(limit)+1))
+	if err != nil || len(bb) == 0 {
+		h.respErr(w, 400, "PayloadEmpty")
 		return
 	}
-	pt := strings.TrimSpace(ah[len("bearer "):])
-	if len(pt) == 0 {
-		h.respErr(w, 403, "InvalidProviderToken")
+	if len(bb) > limit {
+		h.respErr(w, 413, "PayloadTooLarge")
+		return
+	}
+	var pl map[string]interface{}
+	if err := json.Unmarshal(bb, &pl); err != nil || pl == nil {
+		// Both invalid JSON and top level values other than objects
+		// end up here. Literal null leaves pl unset.
+		h.respErr(w, 400, "BadPayload")
 		return
 	}
+	clock := h.Clock
+	if clock == nil {
+		clock = requestClock(r)
+	}
+	req := &APNSRequest{DeviceToken: dt, Header: r.Header, RemoteAddr: r.RemoteAddr, Time: clock.Now(), ProviderToken: pt, TokenHeader: th, TokenClaims: tc, Payload: pl}
+	if len(cc) > 0 {
+		req.ClientCert = cc[0]
+		req.ClientCertChain = cc
+	}
+	if env := requestEnvOf(r); env != nil && env.conn != nil {
+		req.ConnID, req.conn = env.conn.id, env.conn
+	}
+	status, reason := 0, ""
+	for _, ch := range h.CaseHandlers {
+		if status, reason = ch(req); status > 0 {
+			break
+		}
+	}
+	if req.Latency != nil {
+		setLatency(r, req.Latency)
+	}
+	if status > 0 && req.NetFault.Mode != NoNetFault {
+		failRequest(w, r, req.NetFault, status, reason)
+	}
+	switch {
+	case status == 0 || status == 200:
+		h.respSucc(w)
+	case status == 410 && !req.Timestamp.IsZero():
+		respErrTimestamp(w, status, reason, req.Timestamp)
+	default:
+		h.respErr(w, status, reason)
+	}
+}
+
+// parseProviderToken parses the value of authorization header and returns
+// the token along with its decoded JWT header and claims. If the token
+// is missing or malformed, APNS rejection reason is returned instead.
+func parseProviderToken(ah string) (pt string, th, tc map[string]interface{}, reason string) {
+	if !strings.HasPrefix(ah, "bearer ") {
+		return "", nil, nil, "MissingProviderToken"
+	}
+	pt = strings.TrimSpace(ah[len("bearer "):])
+	if len(pt) == 0 {
+		return "", nil, nil, "InvalidProviderToken"
+	}
 	ts := strings.Split(pt, ".")
 	if len(ts) != 3 {
-		h.respErr(w, 403, "InvalidProviderToken")
-		return
+		return "", nil, nil, "InvalidProviderToken"
 	}
 	thb, derr := jwt.DecodeSegment(ts[0])
-	var th map[string]interface{}
 	uerr := json.Unmarshal(thb, &th)
 	if derr != nil || uerr != nil {
-		h.respErr(w, 403, "InvalidProviderToken")
-		return
+		return "", nil, nil, "InvalidProviderToken"
 	}
 	tcb, derr := jwt.DecodeSegment(ts[1])
-	var tc map[string]interface{}
 	uerr = json.Unmarshal(tcb, &tc)
 	if derr != nil || uerr != nil {
-		h.respErr(w, 403, "InvalidProviderToken")
-		return
+		return "", nil, nil, "InvalidProviderToken"
 	}
-	bb, err := ioutil.ReadAll(r.Body)
-	if err != nil || len(bb) == 0 {
-		h.respErr(w, 400, "PayloadEmpty")
-		return
+	return pt, th, tc, ""
+}
+
+// payloadLimit returns maximum payload size for the specified push type.
+func (h *CaseHandler) payloadLimit(pushType string) int {
+	if v, ok := h.PayloadLimits[pushType]; ok {
+		return v
 	}
-	if len(bb) > 4096 {
-		h.respErr(w, 400, "PayloadEmpty") // Need a different reason?
-		return
+	if v, ok := DefaultPayloadLimits[pushType]; ok {
+		return v
 	}
-	req := &APNSRequest{DeviceToken: dt, Header: r.Header, TokenHeader: th, TokenClaims: tc, Payload: nil}
-	for _, ch := range h.CaseHandlers {
-		if status, reason := ch(req); status > 0 {
-			h.respErr(w, status, reason)
-			return
-		}
+	if v, ok := h.PayloadLimits[""]; ok {
+		return v
 	}
-	h.respSucc(w)
-	return
+	return DefaultPayloadLimits[""]
 }
 
 func writeApnsId(w http.ResponseWriter, r *http.Request) {
@@ -144,11 +297,18 @@ func (h *CaseHandler) respErr(w http.ResponseWriter, status int, reason string)
 }
 
 func respErr(w http.ResponseWriter, status int, reason string) {
-	w.WriteHeader(status)
 	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
 	fmt.Fprintf(w, "{\"reason\": \"%v\"}", reason)
 }
 
+func respErrTimestamp(w http.ResponseWriter, status int, reason string, ts time.Time) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	ms := ts.UnixNano() / int64(time.Millisecond)
+	fmt.Fprintf(w, "{\"reason\": \"%v\", \"timestamp\": %v}", reason, ms)
+}
+
 func (h *CaseHandler) respSucc(w http.ResponseWriter) {
 	respSucc(w)
 }
@@ -0,0 +1,234 @@
+// Copyright 2017 Aleksey Blinov. All rights reserved.
+
+package apns2mock
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// HandshakeFault identifies TLS handshake failure emulated by the server.
+type HandshakeFault int
+
+const (
+	// NoHandshakeFault indicates regular TLS handshake.
+	NoHandshakeFault HandshakeFault = iota
+
+	// ExpiredCert presents server certificate that has expired.
+	ExpiredCert
+
+	// WrongHost presents server certificate issued for a different host.
+	WrongHost
+
+	// UntrustedIssuer presents server certificate issued by a certificate
+	// authority the client does not know about.
+	UntrustedIssuer
+
+	// StallHandshake never responds to client's hello message,
+	// leaving the handshake stalled until the client gives up
+	// or the server is closed.
+	StallHandshake
+
+	// HandshakeAlert aborts the handshake with internal_error alert
+	// after receiving client's hello message.
+	HandshakeAlert
+)
+
+var handshakeFaultNames = map[HandshakeFault]string{
+	NoHandshakeFault: "none",
+	ExpiredCert:      "expired-cert",
+	WrongHost:        "wrong-host",
+	UntrustedIssuer:  "untrusted-issuer",
+	StallHandshake:   "stall",
+	HandshakeAlert:   "alert",
+}
+
+func (f HandshakeFault) String() string {
+	if s, ok := handshakeFaultNames[f]; ok {
+		return s
+	}
+	return fmt.Sprintf("HandshakeFault(%d)", int(f))
+}
+
+// HandshakeFaults describes which connection attempts fail
+// TLS handshake and how.
+type HandshakeFaults struct {
+
+	// Fault is the kind of failure.
+	Fault HandshakeFault
+
+	// Every, if not 0, makes every Nth connection attempt fail,
+	// starting with the Nth one.
+	Every uint64
+
+	// Percent is the percentage of connection attempts that fail
+	// if Every is 0. If both are 0, all attempts fail.
+	Percent float64
+
+	// Seed initializes the random number generator deciding which
+	// connection attempts fail when Percent is used.
+	Seed int64
+}
+
+// ParseHandshakeFaults creates HandshakeFaults from their specification.
+// It is fault name, one of expired-cert, wrong-host, untrusted-issuer,
+// stall or alert, optionally followed by "/N" to fail every Nth connection
+// attempt or by "/P%" to fail P percent of them, e.g. "expired-cert/3"
+// or "stall/25%".
+func ParseHandshakeFaults(spec string) (HandshakeFaults, error) {
+	var res HandshakeFaults
+	name, sel := spec, ""
+	if i := strings.Index(spec, "/"); i >= 0 {
+		name, sel = spec[:i], spec[i+1:]
+	}
+	res.Fault = NoHandshakeFault
+	for f, n := range handshakeFaultNames {
+		if n == name {
+			res.Fault = f
+		}
+	}
+	if res.Fault == NoHandshakeFault && name != "none" {
+		return res, fmt.Errorf("apns2mock: unknown handshake fault %q", name)
+	}
+	var err error
+	switch {
+	case sel == "":
+	case strings.HasSuffix(sel, "%"):
+		res.Percent, err = strconv.ParseFloat(strings.TrimSuffix(sel, "%"), 64)
+		res.Seed = time.Now().UnixNano()
+		if err == nil && (res.Percent <= 0 || res.Percent > 100) {
+			err = errors.New("percentage out of range")
+		}
+	default:
+		res.Every, err = strconv.ParseUint(sel, 10, 64)
+		if err == nil && res.Every == 0 {
+			err = errors.New("zero interval")
+		}
+	}
+	if err != nil {
+		return res, fmt.Errorf("apns2mock: invalid handshake fault selector %q", sel)
+	}
+	return res, nil
+}
+
+// SetHandshakeFaults makes future connection attempts fail TLS handshake
+// as described by f. Attempts are counted from the time of the call.
+// Passing zero HandshakeFaults restores regular handshakes.
+//
+// Certificate faults require auto-generated server certificate.
+// With certificates loaded from files, they present certificate
+// issued by an untrusted authority instead.
+func (s *Server) SetHandshakeFaults(f HandshakeFaults) error {
+	if f.Percent < 0 || f.Percent > 100 {
+		return errors.New("apns2mock: handshake fault percentage out of range")
+	}
+	s.hsMu.Lock()
+	defer s.hsMu.Unlock()
+	s.hsFaults = f
+	s.hsRand = rand.New(rand.NewSource(f.Seed))
+	s.hsAttempts = 0
+	return nil
+}
+
+// nextHandshakeFault registers connection attempt and returns
+// the fault it should fail with.
+func (s *Server) nextHandshakeFault() HandshakeFault {
+	s.hsMu.Lock()
+	defer s.hsMu.Unlock()
+	f := s.hsFaults
+	if f.Fault == NoHandshakeFault {
+		return NoHandshakeFault
+	}
+	s.hsAttempts++
+	switch {
+	case f.Every > 0:
+		if s.hsAttempts%f.Every != 0 {
+			return NoHandshakeFault
+		}
+	case f.Percent > 0:
+		if s.hsRand.Float64()*100 >= f.Percent {
+			return NoHandshakeFault
+		}
+	}
+	s.hsInjected++
+	return f.Fault
+}
+
+// faultCert returns server certificate presented for certificate fault f.
+func (s *Server) faultCert(f HandshakeFault) (tls.Certificate, error) {
+	s.hsMu.Lock()
+	defer s.hsMu.Unlock()
+	if c, ok := s.hsCerts[f]; ok {
+		return c, nil
+	}
+	ca := s.ca
+	if ca == nil || f == UntrustedIssuer {
+		var err error
+		if ca, err = newCertAuthority("Untrusted APNS Mock CA"); err != nil {
+			return tls.Certificate{}, err
+		}
+	}
+	hosts, now := s.certHosts, time.Now()
+	notBefore, notAfter := now.Add(-time.Hour), now.Add(365*24*time.Hour)
+	switch f {
+	case ExpiredCert:
+		notBefore, notAfter = now.Add(-48*time.Hour), now.Add(-24*time.Hour)
+	case WrongHost:
+		hosts = []string{"wrong.host.invalid"}
+	}
+	c, err := ca.issue(hosts, notBefore, notAfter)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	if s.hsCerts == nil {
+		s.hsCerts = map[HandshakeFault]tls.Certificate{}
+	}
+	s.hsCerts[f] = c
+	return c, nil
+}
+
+// errHandshakeFault is returned to crypto/tls to abort faulty handshakes.
+var errHandshakeFault = errors.New("apns2mock: injected handshake fault")
+
+// configForClient is tls.Config.GetConfigForClient callback of the server
+// injecting handshake faults.
+func (s *Server) configForClient(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+	switch f := s.nextHandshakeFault(); f {
+	case NoHandshakeFault:
+		return nil, nil
+	case StallHandshake:
+		// Client does not send anything until it receives server's
+		// response, so reading only returns once the client gives up.
+		gone := make(chan struct{})
+		go func() {
+			b := make([]byte, 1)
+			for {
+				if _, err := hello.Conn.Read(b); err != nil {
+					close(gone)
+					return
+				}
+			}
+		}()
+		select {
+		case <-gone:
+		case <-s.done:
+		}
+		return nil, errHandshakeFault
+	case HandshakeAlert:
+		return nil, errHandshakeFault
+	default:
+		c, err := s.faultCert(f)
+		if err != nil {
+			return nil, err
+		}
+		res := s.tlsConfig.Clone()
+		res.GetConfigForClient = nil
+		res.Certificates = []tls.Certificate{c}
+		return res, nil
+	}
+}
@@ -0,0 +1,117 @@
+// Copyright 2017 Aleksey Blinov. All rights reserved.
+
+package apns2mock
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+// HTTP2Cfg contains HTTP/2 settings of the server. Zero values select
+// http2.Server defaults.
+type HTTP2Cfg struct {
+
+	// InitialWindowSize is the flow control window of each stream
+	// for data sent by the client. It is advertised in SETTINGS frame
+	// and must not exceed 2147483647 bytes. Windows smaller than
+	// 65535 bytes reset streams of clients that start sending data
+	// before receiving the SETTINGS frame.
+	InitialWindowSize uint32
+
+	// InitialConnWindowSize is the flow control window of the connection
+	// for data sent by the client. HTTP/2 does not allow it to be less
+	// than 65535 or more than 2147483647 bytes.
+	InitialConnWindowSize uint32
+
+	// MaxFrameSize is the largest frame the client may send. It must be
+	// between 16384 and 16777215 bytes.
+	MaxFrameSize uint32
+
+	// MaxHeaderListSize is the maximum size of request headers.
+	// The server enforces it with a small allowance for HTTP/1
+	// style header framing.
+	MaxHeaderListSize uint32
+
+	// IdleTimeout is the time after which idle connections are closed
+	// with GOAWAY frame.
+	IdleTimeout time.Duration
+
+	// Settings override or extend parameters advertised in server's
+	// initial SETTINGS frame without changing how the server itself
+	// behaves. This allows advertising limits that the server
+	// does not enforce or parameters it does not know about.
+	Settings []http2.Setting
+}
+
+// validate checks that c only contains values allowed by HTTP/2.
+func (c HTTP2Cfg) validate() error {
+	const maxWindow = 1<<31 - 1
+	if c.InitialWindowSize > maxWindow {
+		return errors.New("apns2mock: HTTP/2 window size must not exceed 2147483647")
+	}
+	if c.InitialConnWindowSize != 0 && (c.InitialConnWindowSize < 65535 || c.InitialConnWindowSize > maxWindow) {
+		return errors.New("apns2mock: HTTP/2 connection window size must be between 65535 and 2147483647")
+	}
+	if c.MaxFrameSize != 0 && (c.MaxFrameSize < 16384 || c.MaxFrameSize > 1<<24-1) {
+		return errors.New("apns2mock: HTTP/2 max frame size must be between 16384 and 16777215")
+	}
+	return nil
+}
+
+// apply applies c to HTTP/1 server hs and HTTP/2 server h2.
+// c must be valid.
+func (c HTTP2Cfg) apply(hs *http.Server, h2 *http2.Server) {
+	h2.MaxUploadBufferPerStream = int32(c.InitialWindowSize)
+	h2.MaxUploadBufferPerConnection = int32(c.InitialConnWindowSize)
+	h2.MaxReadFrameSize = c.MaxFrameSize
+	h2.IdleTimeout = c.IdleTimeout
+	hs.MaxHeaderBytes = int(c.MaxHeaderListSize)
+}
+
+// advertised returns parameters to be advertised in place of those
+// http2.Server sends in its initial SETTINGS frame.
+func (c HTTP2Cfg) advertised() []http2.Setting {
+	var res []http2.Setting
+	if c.MaxHeaderListSize > 0 {
+		// http2.Server adds its allowance to the advertised value.
+		res = append(res, http2.Setting{ID: http2.SettingMaxHeaderListSize, Val: c.MaxHeaderListSize})
+	}
+	return append(res, c.Settings...)
+}
+
+// rewriteSettings returns SETTINGS frame f with parameters
+// overridden or extended by settings. Frames other than SETTINGS
+// are returned unchanged.
+func rewriteSettings(f []byte, settings []http2.Setting) []byte {
+	if len(f) < 9 || http2.FrameType(f[3]) != http2.FrameSettings || http2.Flags(f[4])&http2.FlagSettingsAck != 0 {
+		return f
+	}
+	var res []http2.Setting
+	for p := f[9:]; len(p) >= 6; p = p[6:] {
+		res = append(res, http2.Setting{
+			ID:  http2.SettingID(uint16(p[0])<<8 | uint16(p[1])),
+			Val: uint32(p[2])<<24 | uint32(p[3])<<16 | uint32(p[4])<<8 | uint32(p[5]),
+		})
+	}
+	for _, s := range settings {
+		found := false
+		for i := range res {
+			if res[i].ID == s.ID {
+				res[i].Val = s.Val
+				found = true
+			}
+		}
+		if !found {
+			res = append(res, s)
+		}
+	}
+	var buf bytes.Buffer
+	if err := http2.NewFramer(&buf, nil).WriteSettings(res...); err != nil {
+		return f
+	}
+	return buf.Bytes()
+}
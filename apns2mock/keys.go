@@ -0,0 +1,98 @@
+// Copyright 2017 Aleksey Blinov. All rights reserved.
+
+package apns2mock
+
+import (
+	"crypto/ecdsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"strings"
+	"sync"
+
+	jwt "github.com/dgrijalva/jwt-go"
+)
+
+// ProviderKeys holds public keys used for verifying signatures of
+// JWT provider tokens. Each key is registered under its key ID
+// together with the team ID it was issued to.
+//
+// ProviderKeys is safe for concurrent use.
+type ProviderKeys struct {
+	mu   sync.RWMutex
+	keys map[string]providerKey
+}
+
+type providerKey struct {
+	teamID string
+	key    *ecdsa.PublicKey
+}
+
+// NewProviderKeys creates a new empty key registry.
+func NewProviderKeys() *ProviderKeys {
+	return &ProviderKeys{keys: map[string]providerKey{}}
+}
+
+// Add registers public key with the specified team ID and key ID.
+// Any key previously registered under the same key ID is replaced.
+func (k *ProviderKeys) Add(teamID, keyID string, key *ecdsa.PublicKey) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.keys[keyID] = providerKey{teamID: teamID, key: key}
+}
+
+// AddP8 registers public part of PEM encoded private key, such as
+// the contents of .p8 file downloaded from Apple developer account.
+func (k *ProviderKeys) AddP8(teamID, keyID string, p8 []byte) error {
+	block, _ := pem.Decode(p8)
+	if block == nil {
+		return errors.New("apns2mock: no PEM data found in private key")
+	}
+	var pk *ecdsa.PrivateKey
+	if key, err := x509.ParsePKCS8PrivateKey(block.Bytes); err == nil {
+		var ok bool
+		if pk, ok = key.(*ecdsa.PrivateKey); !ok {
+			return errors.New("apns2mock: private key is not an ECDSA key")
+		}
+	} else if pk, err = x509.ParseECPrivateKey(block.Bytes); err != nil {
+		return err
+	}
+	k.Add(teamID, keyID, &pk.PublicKey)
+	return nil
+}
+
+// LoadP8File registers public part of the private key loaded from
+// the specified .p8 file.
+func (k *ProviderKeys) LoadP8File(teamID, keyID, path string) error {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	return k.AddP8(teamID, keyID, b)
+}
+
+// Remove removes the key registered under the specified key ID.
+func (k *ProviderKeys) Remove(keyID string) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	delete(k.keys, keyID)
+}
+
+// verify checks that provider token pt is signed with a registered key
+// and that it is issued by the team the key belongs to.
+func (k *ProviderKeys) verify(pt string, th, tc map[string]interface{}) bool {
+	kid, _ := th["kid"].(string)
+	iss, _ := tc["iss"].(string)
+	k.mu.RLock()
+	pk, ok := k.keys[kid]
+	k.mu.RUnlock()
+	if !ok || pk.teamID != iss {
+		return false
+	}
+	if alg, _ := th["alg"].(string); alg != jwt.SigningMethodES256.Alg() {
+		return false
+	}
+	i := strings.LastIndex(pt, ".")
+	return jwt.SigningMethodES256.Verify(pt[:i], pt[i+1:], pk.key) == nil
+}
@@ -0,0 +1,368 @@
+// Copyright 2017 Aleksey Blinov. All rights reserved.
+
+package apns2mock
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Latency is a distribution of response times. Use FixedLatency,
+// UniformLatency, NormalLatency, LogNormalLatency or HistogramLatency
+// to create one, WithSpikes to add occasional long-tail delays to it,
+// or ParseLatency to create one from its textual specification.
+type Latency interface {
+
+	// Next returns randomly chosen response time.
+	Next() time.Duration
+
+	// String returns specification of the distribution
+	// in the format accepted by ParseLatency.
+	String() string
+}
+
+// latencyRand is random number generator shared by all distributions.
+var latencyRand = struct {
+	sync.Mutex
+	*rand.Rand
+}{Rand: rand.New(rand.NewSource(time.Now().UnixNano()))}
+
+func randFloat64() float64 {
+	latencyRand.Lock()
+	defer latencyRand.Unlock()
+	return latencyRand.Float64()
+}
+
+func randNormFloat64() float64 {
+	latencyRand.Lock()
+	defer latencyRand.Unlock()
+	return latencyRand.NormFloat64()
+}
+
+// nonNegative converts v nanoseconds to duration clamping it at 0.
+func nonNegative(v float64) time.Duration {
+	if v < 0 {
+		return 0
+	}
+	return time.Duration(v)
+}
+
+type fixedLatency time.Duration
+
+// FixedLatency returns Latency that always takes d.
+func FixedLatency(d time.Duration) Latency {
+	return fixedLatency(d)
+}
+
+func (l fixedLatency) Next() time.Duration {
+	return time.Duration(l)
+}
+
+func (l fixedLatency) String() string {
+	return time.Duration(l).String()
+}
+
+type uniformLatency struct {
+	min, max time.Duration
+}
+
+// UniformLatency returns Latency uniformly distributed between min and max.
+func UniformLatency(min, max time.Duration) Latency {
+	if max < min {
+		min, max = max, min
+	}
+	return uniformLatency{min, max}
+}
+
+func (l uniformLatency) Next() time.Duration {
+	return l.min + time.Duration(randFloat64()*float64(l.max-l.min))
+}
+
+func (l uniformLatency) String() string {
+	return fmt.Sprintf("uniform:%v,%v", l.min, l.max)
+}
+
+type normalLatency struct {
+	mean, stddev time.Duration
+}
+
+// NormalLatency returns normally distributed Latency with the specified
+// mean and standard deviation. Negative values are taken to be 0.
+func NormalLatency(mean, stddev time.Duration) Latency {
+	return normalLatency{mean, stddev}
+}
+
+func (l normalLatency) Next() time.Duration {
+	return nonNegative(float64(l.mean) + randNormFloat64()*float64(l.stddev))
+}
+
+func (l normalLatency) String() string {
+	return fmt.Sprintf("normal:%v,%v", l.mean, l.stddev)
+}
+
+type logNormalLatency struct {
+	median time.Duration
+	sigma  float64
+}
+
+// LogNormalLatency returns log-normally distributed Latency with
+// the specified median. Sigma is the standard deviation of the logarithm
+// of response time and controls the length of distribution's tail,
+// e.g. with sigma 0.5 about 1% of responses take over 3.2 times the median.
+func LogNormalLatency(median time.Duration, sigma float64) Latency {
+	return logNormalLatency{median, sigma}
+}
+
+func (l logNormalLatency) Next() time.Duration {
+	return nonNegative(float64(l.median) * math.Exp(randNormFloat64()*l.sigma))
+}
+
+func (l logNormalLatency) String() string {
+	return fmt.Sprintf("lognormal:%v,%v", l.median, strconv.FormatFloat(l.sigma, 'g', -1, 64))
+}
+
+// Percentile is a point of empirical response time distribution.
+type Percentile struct {
+
+	// P is the percentage of responses taking no longer than D.
+	P float64
+
+	// D is response time.
+	D time.Duration
+}
+
+type histogramLatency []Percentile
+
+// HistogramLatency returns Latency following empirical distribution
+// described by percentiles, e.g. p50 of 20ms, p90 of 40ms and p99
+// of 150ms. Response times between percentiles are interpolated linearly.
+// Responses below the lowest percentile take its time and responses
+// above the highest percentile take its time.
+func HistogramLatency(ps ...Percentile) (Latency, error) {
+	if len(ps) == 0 {
+		return nil, errors.New("apns2mock: no percentiles supplied")
+	}
+	res := append(histogramLatency{}, ps...)
+	sort.Sort(res)
+	for i, p := range res {
+		if p.P < 0 || p.P > 100 {
+			return nil, fmt.Errorf("apns2mock: invalid percentile %v", p.P)
+		}
+		if i > 0 && (p.P == res[i-1].P || p.D < res[i-1].D) {
+			return nil, fmt.Errorf("apns2mock: percentile %v is inconsistent with percentile %v", p.P, res[i-1].P)
+		}
+	}
+	return res, nil
+}
+
+func (l histogramLatency) Len() int           { return len(l) }
+func (l histogramLatency) Swap(i, j int)      { l[i], l[j] = l[j], l[i] }
+func (l histogramLatency) Less(i, j int) bool { return l[i].P < l[j].P }
+
+func (l histogramLatency) Next() time.Duration {
+	v := randFloat64() * 100
+	if v <= l[0].P {
+		return l[0].D
+	}
+	for i := 1; i < len(l); i++ {
+		if v <= l[i].P {
+			lo, hi := l[i-1], l[i]
+			return lo.D + time.Duration((v-lo.P)/(hi.P-lo.P)*float64(hi.D-lo.D))
+		}
+	}
+	return l[len(l)-1].D
+}
+
+func (l histogramLatency) String() string {
+	ps := make([]string, len(l))
+	for i, p := range l {
+		ps[i] = fmt.Sprintf("%v=%v", strconv.FormatFloat(p.P, 'g', -1, 64), p.D)
+	}
+	return "histogram:" + strings.Join(ps, ",")
+}
+
+type spikyLatency struct {
+	Latency
+	percent float64
+	spike   time.Duration
+}
+
+// WithSpikes returns Latency following l except for the specified
+// percentage of responses, which take spike instead.
+func WithSpikes(l Latency, percent float64, spike time.Duration) Latency {
+	return spikyLatency{l, percent, spike}
+}
+
+func (l spikyLatency) Next() time.Duration {
+	if randFloat64()*100 < l.percent {
+		return l.spike
+	}
+	return l.Latency.Next()
+}
+
+func (l spikyLatency) String() string {
+	return fmt.Sprintf("%v+spikes:%v%%,%v", l.Latency, strconv.FormatFloat(l.percent, 'g', -1, 64), l.spike)
+}
+
+// ParseLatency creates Latency from its specification, which is one of
+//
+//	20ms                               fixed response time
+//	uniform:10ms,50ms                  uniformly distributed between 10ms and 50ms
+//	normal:20ms,5ms                    normally distributed with mean 20ms and standard deviation 5ms
+//	lognormal:20ms,0.5                 log-normally distributed with median 20ms and sigma 0.5
+//	histogram:50=20ms,90=40ms,99=150ms empirical distribution with p50 of 20ms, p90 of 40ms and p99 of 150ms
+//
+// optionally followed by spikes specification, e.g. "+spikes:0.5%,2s"
+// to make 0.5% of responses take 2 seconds.
+func ParseLatency(spec string) (Latency, error) {
+	res, err := parseLatency(spec)
+	if err != nil {
+		return nil, fmt.Errorf("apns2mock: invalid latency %q: %v", spec, err)
+	}
+	return res, nil
+}
+
+func parseLatency(spec string) (Latency, error) {
+	spec = strings.TrimSpace(spec)
+	if i := strings.Index(spec, "+spikes:"); i >= 0 {
+		l, err := parseLatency(spec[:i])
+		if err != nil {
+			return nil, err
+		}
+		args := strings.Split(spec[i+len("+spikes:"):], ",")
+		if len(args) != 2 {
+			return nil, errors.New("spikes require percentage and duration")
+		}
+		percent, err := strconv.ParseFloat(strings.TrimSuffix(strings.TrimSpace(args[0]), "%"), 64)
+		if err != nil {
+			return nil, err
+		}
+		spike, err := time.ParseDuration(strings.TrimSpace(args[1]))
+		if err != nil {
+			return nil, err
+		}
+		return WithSpikes(l, percent, spike), nil
+	}
+	kind, args := "fixed", spec
+	if i := strings.Index(spec, ":"); i >= 0 {
+		kind, args = spec[:i], spec[i+1:]
+	}
+	as := strings.Split(args, ",")
+	for i := range as {
+		as[i] = strings.TrimSpace(as[i])
+	}
+	switch kind {
+	case "fixed":
+		d, err := time.ParseDuration(args)
+		if err != nil {
+			return nil, err
+		}
+		return FixedLatency(d), nil
+	case "uniform", "normal":
+		if len(as) != 2 {
+			return nil, fmt.Errorf("%v distribution requires two durations", kind)
+		}
+		a, err := time.ParseDuration(as[0])
+		if err != nil {
+			return nil, err
+		}
+		b, err := time.ParseDuration(as[1])
+		if err != nil {
+			return nil, err
+		}
+		if kind == "uniform" {
+			return UniformLatency(a, b), nil
+		}
+		return NormalLatency(a, b), nil
+	case "lognormal":
+		if len(as) != 2 {
+			return nil, errors.New("lognormal distribution requires median and sigma")
+		}
+		median, err := time.ParseDuration(as[0])
+		if err != nil {
+			return nil, err
+		}
+		sigma, err := strconv.ParseFloat(as[1], 64)
+		if err != nil {
+			return nil, err
+		}
+		return LogNormalLatency(median, sigma), nil
+	case "histogram":
+		ps := make([]Percentile, len(as))
+		for i, a := range as {
+			kv := strings.SplitN(a, "=", 2)
+			if len(kv) != 2 {
+				return nil, fmt.Errorf("percentile %q is not in p=duration format", a)
+			}
+			p, err := strconv.ParseFloat(strings.TrimPrefix(kv[0], "p"), 64)
+			if err != nil {
+				return nil, err
+			}
+			d, err := time.ParseDuration(kv[1])
+			if err != nil {
+				return nil, err
+			}
+			ps[i] = Percentile{P: p, D: d}
+		}
+		return HistogramLatency(ps...)
+	}
+	return nil, fmt.Errorf("unknown distribution %v", kind)
+}
+
+// delayingWriter delays sending of the response until response time
+// chosen for the request elapses.
+type delayingWriter struct {
+	http.ResponseWriter
+	env     *requestEnv
+	started time.Time
+	waited  bool
+}
+
+// wait blocks until response time elapses.
+func (w *delayingWriter) wait() {
+	if w.waited {
+		return
+	}
+	w.waited = true
+	if d := w.env.delay - time.Since(w.started); d > 0 {
+		time.Sleep(d)
+	}
+}
+
+func (w *delayingWriter) WriteHeader(status int) {
+	w.wait()
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *delayingWriter) Write(b []byte) (int, error) {
+	w.wait()
+	return w.ResponseWriter.Write(b)
+}
+
+// Flush sends any buffered data to the client.
+func (w *delayingWriter) Flush() {
+	w.wait()
+	if fl, ok := w.ResponseWriter.(http.Flusher); ok {
+		fl.Flush()
+	}
+}
+
+// setLatency makes response to request r take time chosen by l
+// instead of server's response time. If r is not served by Server,
+// the calling goroutine sleeps for the chosen time instead.
+func setLatency(r *http.Request, l Latency) {
+	d := l.Next()
+	if env := requestEnvOf(r); env != nil {
+		env.delay = d
+		return
+	}
+	time.Sleep(d)
+}
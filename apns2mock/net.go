@@ -22,8 +22,13 @@ type cappedConnListener struct {
 	// are delayed.
 	Delay time.Duration
 
-	mu  sync.Mutex
-	cnt uint32
+	// Now, if not nil, returns the time connections are accepted at.
+	Now func() time.Time
+
+	mu     sync.Mutex
+	cnt    uint32
+	nextID uint64
+	conns  map[string]*netConn
 }
 
 // See net.Listener.Accept() for more information.
@@ -37,10 +42,22 @@ func (l *cappedConnListener) Accept() (res net.Conn, err error) {
 		hasCap := l.cnt < l.Cap
 		if hasCap {
 			l.cnt++
-			res = &netConn{res.(*net.TCPConn), l}
+			l.nextID++
+			nc := &netConn{TCPConn: res.(*net.TCPConn), l: l, id: l.nextID}
+			nc.addr = nc.RemoteAddr().String()
+			nc.accepted = time.Now()
+			if l.Now != nil {
+				nc.accepted = l.Now()
+			}
+			if l.conns == nil {
+				l.conns = map[string]*netConn{}
+			}
+			l.conns[nc.addr] = nc
+			res = nc
+			delay := l.Delay
 			l.mu.Unlock()
-			if l.Delay > 0 {
-				time.Sleep(l.Delay)
+			if delay > 0 {
+				time.Sleep(delay)
 			}
 			return
 		}
@@ -50,17 +67,110 @@ func (l *cappedConnListener) Accept() (res net.Conn, err error) {
 	return
 }
 
+// setDelay changes the amount of time by which future Accept() calls
+// are delayed.
+func (l *cappedConnListener) setDelay(d time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.Delay = d
+}
+
+// counts returns the number of currently open connections and the total
+// number of connections accepted by the listener.
+func (l *cappedConnListener) counts() (open int, accepted uint64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return len(l.conns), l.nextID
+}
+
+// conn returns accepted connection with the specified remote address
+// or nil if no such connection is currently open.
+func (l *cappedConnListener) conn(remoteAddr string) *netConn {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.conns[remoteAddr]
+}
+
 type netConn struct {
 	*net.TCPConn
 	l *cappedConnListener
+
+	// id uniquely identifies connection among all connections
+	// accepted by the listener.
+	id uint64
+
+	// addr is the remote address connection is registered under.
+	addr string
+
+	// accepted is the time the connection was accepted at.
+	accepted time.Time
+
+	// The following are guarded by l.mu.
+
+	// h2 is HTTP/2 connection wrapping this connection once
+	// TLS handshake is complete.
+	h2 *h2Conn
+
+	// served and active count completed and in-flight notification
+	// requests.
+	served uint64
+	active int
+
+	// team and key are the team ID and key ID of the provider token
+	// last seen on the connection.
+	team string
+	key  string
+
+	closed bool
+
+	// onClose are called once the connection is closed.
+	onClose []func()
+}
+
+// whenClosed arranges for f to be called once the connection is closed.
+// It returns false without doing so if the connection is already closed.
+func (c *netConn) whenClosed(f func()) bool {
+	c.l.mu.Lock()
+	defer c.l.mu.Unlock()
+	if c.closed {
+		return false
+	}
+	c.onClose = append(c.onClose, f)
+	return true
+}
+
+// reset abruptly closes the connection making the peer
+// receive TCP RST.
+func (c *netConn) reset() {
+	c.SetLinger(0)
+	c.Close()
+}
+
+// h2Conn returns HTTP/2 connection wrapping this connection
+// or nil if there is none yet.
+func (c *netConn) h2Conn() *h2Conn {
+	c.l.mu.Lock()
+	defer c.l.mu.Unlock()
+	return c.h2
 }
 
 func (c *netConn) Close() error {
 	res := c.TCPConn.Close()
 	c.l.mu.Lock()
-	defer c.l.mu.Unlock()
+	if c.closed {
+		c.l.mu.Unlock()
+		return res
+	}
+	c.closed = true
 	if c.l.cnt > 0 {
 		c.l.cnt--
 	}
+	delete(c.l.conns, c.addr)
+	onClose := c.onClose
+	c.onClose = nil
+	c.l.mu.Unlock()
+	for _, f := range onClose {
+		f()
+	}
 	return res
 }
@@ -0,0 +1,138 @@
+// Copyright 2017 Aleksey Blinov. All rights reserved.
+
+package apns2mock
+
+import (
+	"fmt"
+	"net/http"
+
+	"golang.org/x/net/http2"
+)
+
+// NetFaultMode identifies network-level failure emulated in place
+// of a regular response.
+type NetFaultMode int
+
+const (
+	// NoNetFault indicates regular response.
+	NoNetFault NetFaultMode = iota
+
+	// ResetConnection abruptly resets TCP connection the request
+	// was received on, failing all requests in flight on it.
+	ResetConnection
+
+	// ResetStream resets HTTP/2 stream of the request with RST_STREAM frame.
+	ResetStream
+
+	// Hang leaves the request without any response until the client
+	// gives up on it or the server is closed.
+	Hang
+
+	// HalfWrite sends response headers and a part of response body
+	// and then resets HTTP/2 stream of the request with RST_STREAM frame.
+	HalfWrite
+)
+
+var netFaultModeNames = map[NetFaultMode]string{
+	NoNetFault:      "none",
+	ResetConnection: "reset-connection",
+	ResetStream:     "reset-stream",
+	Hang:            "hang",
+	HalfWrite:       "half-write",
+}
+
+func (m NetFaultMode) String() string {
+	if s, ok := netFaultModeNames[m]; ok {
+		return s
+	}
+	return fmt.Sprintf("NetFaultMode(%d)", int(m))
+}
+
+// parseNetFaultMode returns network fault mode with name s.
+func parseNetFaultMode(s string) (NetFaultMode, bool) {
+	for m, name := range netFaultModeNames {
+		if name == s {
+			return m, true
+		}
+	}
+	return NoNetFault, false
+}
+
+// NetFault describes network-level failure.
+type NetFault struct {
+
+	// Mode is the kind of failure.
+	Mode NetFaultMode
+
+	// ErrCode is the error code sent in RST_STREAM frame for ResetStream
+	// and HalfWrite faults. http2.ErrCodeNo is taken to mean
+	// http2.ErrCodeInternal, which is what http2.Server sends
+	// when request handler is aborted. Other codes can only be sent
+	// if the ID of the stream can be found in http2.Server's response
+	// writer. A warning is logged if it cannot.
+	ErrCode http2.ErrCode
+}
+
+// BecomeFaulty makes server fail all future requests with network fault f
+// instead of responding to them. BecomeAvailable restores normal request
+// handling flow.
+func (s *Server) BecomeFaulty(f NetFault) {
+	s.interceptor.Store(func(w http.ResponseWriter, r *http.Request) bool {
+		if f.Mode == NoNetFault {
+			return false
+		}
+		failRequest(w, r, f, 0, "")
+		return true
+	})
+}
+
+// failRequest emulates network fault f in place of responding to request r
+// with status and reason. It never returns if f is an actual fault.
+//
+// Faults affecting connections and streams rely on the request being
+// served by Server. Otherwise stream is reset with http2.ErrCodeInternal
+// instead.
+func failRequest(w http.ResponseWriter, r *http.Request, f NetFault, status int, reason string) {
+	env := requestEnvOf(r)
+	if env != nil {
+		env.fault = f.Mode
+	}
+	switch f.Mode {
+	case NoNetFault:
+		return
+	case ResetConnection:
+		if env != nil && env.conn != nil {
+			env.conn.reset()
+		}
+	case Hang:
+		var done <-chan struct{}
+		if env != nil {
+			done = env.done
+		}
+		select {
+		case <-r.Context().Done():
+		case <-done:
+		}
+	case HalfWrite:
+		if status == 0 {
+			status = 200
+		}
+		body := fmt.Sprintf("{\"reason\": \"%v\"}", reason)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		w.Write([]byte(body[:len(body)/2]))
+		if fl, ok := w.(http.Flusher); ok {
+			fl.Flush()
+		}
+	}
+	if f.Mode == ResetStream || f.Mode == HalfWrite {
+		if env != nil && env.conn != nil && env.stream != 0 && f.ErrCode != http2.ErrCodeNo {
+			if c := env.conn.h2Conn(); c != nil {
+				c.rewriteReset(env.stream, f.ErrCode)
+			}
+		}
+	}
+	// Aborting the handler makes http2.Server reset the stream
+	// without sending any further response.
+	panic(http.ErrAbortHandler)
+}
@@ -0,0 +1,352 @@
+// Copyright 2017 Aleksey Blinov. All rights reserved.
+
+package apns2mock
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Notification is a record of a request received by the server
+// on RequestRoot path along with the response sent back to the client.
+//
+// Request attributes are decoded on the best effort basis. Invalid provider
+// tokens and payloads are recorded as nil TokenHeader, TokenClaims
+// and Payload.
+type Notification struct {
+
+	// ID is APNS notification ID sent back to the client in apns-id header.
+	ID string
+
+	// ConnID identifies the connection the request was received on.
+	ConnID uint64
+
+	// Time is the time the request was received at according
+	// to server's clock.
+	Time time.Time
+
+	// Expiration is the time specified in apns-expiration header,
+	// or zero time if the header is missing, invalid or set to 0.
+	Expiration time.Time
+
+	// Expired indicates that the notification had expired by the time
+	// it was received. APNS would discard such notification without
+	// attempting to deliver it. The server accepts such notifications
+	// as APNS does, and predefined case handlers do not reject them.
+	Expired bool
+
+	// DeviceToken is device token from the original request path.
+	DeviceToken string
+
+	// Header is http.Header of the original request.
+	Header http.Header
+
+	// TokenHeader is decoded header of JWT provider token.
+	TokenHeader map[string]interface{}
+
+	// TokenClaims is decoded claims of JWT provider token.
+	TokenClaims map[string]interface{}
+
+	// RawPayload is the original request body. Bodies exceeding
+	// the payload limit are truncated one byte past the limit.
+	RawPayload []byte
+
+	// Payload is parsed request payload.
+	Payload map[string]interface{}
+
+	// Status is HTTP status code of the response.
+	Status int
+
+	// Reason is rejection reason sent in the response,
+	// or empty string for successful responses.
+	Reason string
+
+	// NetFault is the network fault the request was failed with,
+	// if any. Status of such requests is 0 unless response headers
+	// were sent before the failure.
+	NetFault NetFaultMode
+}
+
+// recorder keeps track of notifications received by the server.
+type recorder struct {
+	mu sync.Mutex
+	ns []Notification
+
+	// limit is the maximum number of notifications kept. Only the most
+	// recent notifications are kept if it is positive, and none are kept
+	// if it is negative.
+	limit int
+
+	// received and statuses count all notifications received, including
+	// those that are no longer kept.
+	received int
+	statuses map[int]int
+
+	// changed is closed and reset whenever recorded notifications change.
+	changed chan struct{}
+}
+
+func (r *recorder) add(n Notification) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.received++
+	if r.statuses == nil {
+		r.statuses = map[int]int{}
+	}
+	r.statuses[n.Status]++
+	if r.limit >= 0 {
+		r.ns = append(r.ns, n)
+	}
+	if r.limit > 0 && len(r.ns) > r.limit {
+		// Discarded notifications are released once append reallocates.
+		r.ns = r.ns[len(r.ns)-r.limit:]
+	}
+	r.notify()
+}
+
+// setLimit changes the maximum number of notifications kept
+// discarding the oldest ones if necessary.
+func (r *recorder) setLimit(limit int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.limit = limit
+	switch {
+	case limit < 0:
+		r.ns = nil
+	case limit > 0 && len(r.ns) > limit:
+		r.ns = append([]Notification{}, r.ns[len(r.ns)-limit:]...)
+	}
+	r.notify()
+}
+
+// counts returns the number of notifications received
+// along with their counts by response status.
+func (r *recorder) counts() (int, map[int]int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	statuses := map[int]int{}
+	for k, v := range r.statuses {
+		statuses[k] = v
+	}
+	return r.received, statuses
+}
+
+// notify wakes up all goroutines waiting for notifications.
+// It must be called with r.mu held.
+func (r *recorder) notify() {
+	if r.changed != nil {
+		close(r.changed)
+		r.changed = nil
+	}
+}
+
+// filter returns all recorded notifications for which f returns true.
+func (r *recorder) filter(f func(n *Notification) bool) []Notification {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.filterLocked(f)
+}
+
+// filterLocked is the same as filter, but it must be called with r.mu held.
+func (r *recorder) filterLocked(f func(n *Notification) bool) []Notification {
+	res := []Notification{}
+	for i := range r.ns {
+		if f == nil || f(&r.ns[i]) {
+			res = append(res, r.ns[i])
+		}
+	}
+	return res
+}
+
+func (r *recorder) reset() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.ns = nil
+	r.received, r.statuses = 0, nil
+	r.notify()
+}
+
+// wait blocks until at least n recorded notifications satisfy f
+// or until ctx is done. It returns all notifications satisfying f
+// along with the number of recorded notifications that do not.
+// It fails right away if the record limit does not allow keeping
+// n notifications.
+func (r *recorder) wait(ctx context.Context, f func(n *Notification) bool, n int) ([]Notification, int, error) {
+	for {
+		r.mu.Lock()
+		res := r.filterLocked(f)
+		others := len(r.ns) - len(res)
+		if len(res) >= n {
+			r.mu.Unlock()
+			return res, others, nil
+		}
+		if limit := r.limit; limit < 0 || limit > 0 && n > limit {
+			r.mu.Unlock()
+			return res, others, fmt.Errorf("apns2mock: cannot wait for %v notifications with record limit %v", n, limit)
+		}
+		if r.changed == nil {
+			r.changed = make(chan struct{})
+		}
+		ch := r.changed
+		r.mu.Unlock()
+		select {
+		case <-ch:
+		case <-ctx.Done():
+			return res, others, ctx.Err()
+		}
+	}
+}
+
+// newNotification decodes request r received at time now into a new
+// Notification. At most limit+1 bytes of request body are consumed
+// and put back in front of the rest of the body so that it can be read
+// by request handlers.
+func newNotification(r *http.Request, now time.Time, limit int) Notification {
+	res := Notification{
+		Time:        now,
+		DeviceToken: strings.TrimPrefix(r.URL.Path, RequestRoot),
+		Header:      r.Header,
+	}
+	if exp, err := strconv.ParseInt(r.Header.Get("apns-expiration"), 10, 64); err == nil && exp != 0 {
+		res.Expiration = time.Unix(exp, 0)
+		res.Expired = res.Expiration.Before(now)
+	}
+	_, res.TokenHeader, res.TokenClaims, _ = parseProviderToken(r.Header.Get("authorization"))
+	bb, _ := ioutil.ReadAll(io.LimitReader(r.Body, int64(limit)+1))
+	res.RawPayload = bb
+	json.Unmarshal(bb, &res.Payload)
+	r.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(bb), r.Body), r.Body}
+	return res
+}
+
+// recordingWriter is http.ResponseWriter that keeps track of response
+// status and body.
+type recordingWriter struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (w *recordingWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *recordingWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = 200
+	}
+	w.body.Write(b)
+	return w.ResponseWriter.Write(b)
+}
+
+// Flush sends any buffered data to the client.
+func (w *recordingWriter) Flush() {
+	if fl, ok := w.ResponseWriter.(http.Flusher); ok {
+		fl.Flush()
+	}
+}
+
+// record fills in response details of notification n.
+func (w *recordingWriter) record(n *Notification) {
+	n.ID = w.Header().Get("apns-id")
+	n.Status = w.status
+	if n.Status == 0 {
+		n.Status = 200
+	}
+	var body struct {
+		Reason string `json:"reason"`
+	}
+	json.Unmarshal(w.body.Bytes(), &body)
+	n.Reason = body.Reason
+}
+
+// Received returns all notifications received by the server
+// since it was started or since the last call to Reset.
+func (s *Server) Received() []Notification {
+	return s.recorder.filter(nil)
+}
+
+// ReceivedFor returns all notifications received by the server
+// for the specified device token.
+func (s *Server) ReceivedFor(token string) []Notification {
+	return s.recorder.filter(func(n *Notification) bool {
+		return strings.EqualFold(n.DeviceToken, token)
+	})
+}
+
+// WaitForCount blocks until the server has served at least n notifications
+// or until timeout expires. It returns all notifications received so far.
+// If timeout expires, the returned error describes how many
+// notifications were received.
+func (s *Server) WaitForCount(n int, timeout time.Duration) ([]Notification, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	res, _, err := s.recorder.wait(ctx, nil, n)
+	if err != nil && err == ctx.Err() {
+		err = fmt.Errorf("apns2mock: timed out after %v waiting for %v notifications, received %v", timeout, n, len(res))
+	}
+	return res, err
+}
+
+// WaitForCountContext is the same as WaitForCount, but it waits until ctx
+// is done instead of waiting for a timeout to expire.
+func (s *Server) WaitForCountContext(ctx context.Context, n int) ([]Notification, error) {
+	res, _, err := s.recorder.wait(ctx, nil, n)
+	if err != nil && err == ctx.Err() {
+		err = fmt.Errorf("apns2mock: %v while waiting for %v notifications, received %v", err, n, len(res))
+	}
+	return res, err
+}
+
+// WaitFor blocks until the server has served at least one notification
+// for which f returns true or until timeout expires. It returns all
+// served notifications for which f returns true.
+func (s *Server) WaitFor(f func(n Notification) bool, timeout time.Duration) ([]Notification, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	res, others, err := s.recorder.wait(ctx, func(n *Notification) bool { return f(*n) }, 1)
+	if err != nil && err == ctx.Err() {
+		err = fmt.Errorf("apns2mock: timed out after %v waiting for matching notifications, received %v other", timeout, others)
+	}
+	return res, err
+}
+
+// WaitForContext is the same as WaitFor, but it waits until ctx is done
+// instead of waiting for a timeout to expire.
+func (s *Server) WaitForContext(ctx context.Context, f func(n Notification) bool) ([]Notification, error) {
+	res, others, err := s.recorder.wait(ctx, func(n *Notification) bool { return f(*n) }, 1)
+	if err != nil && err == ctx.Err() {
+		err = fmt.Errorf("apns2mock: %v while waiting for matching notifications, received %v other", err, others)
+	}
+	return res, err
+}
+
+// Reset discards all notifications recorded by the server.
+func (s *Server) Reset() {
+	s.recorder.reset()
+}
+
+// SetRecordLimit limits the number of notifications kept by the server
+// to n most recent ones, discarding the oldest ones as new notifications
+// arrive. Zero n removes the limit and negative n disables recording.
+// Stats still count all received notifications. Long-running servers
+// should set a limit to keep memory use in bounds. Waiting for more
+// notifications than the limit allows fails right away.
+func (s *Server) SetRecordLimit(n int) {
+	s.recorder.setLimit(n)
+}
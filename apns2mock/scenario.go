@@ -0,0 +1,294 @@
+// Copyright 2017 Aleksey Blinov. All rights reserved.
+
+package apns2mock
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Scenario is a declarative alternative to writing case handlers in Go.
+// It contains a list of rules that are evaluated in order of their
+// appearance. The first rule matching the request determines
+// the response. Scenarios are typically loaded from YAML or JSON files:
+//
+//	rules:
+//	  - name: unregistered device
+//	    device_token: 2a1f0c
+//	    status: 410
+//	    reason: Unregistered
+//	  - device_token_prefix: ff
+//	    topic: com.example.app
+//	    push_type: voip
+//	    delay: 250ms
+//	    status: 200
+//	  - team: TEAM000001
+//	    payload:
+//	      aps.alert.title: Boom
+//	    status: 500
+//	    reason: InternalServerError
+//
+// See ScenarioRule for the list of supported attributes.
+type Scenario struct {
+	Rules []ScenarioRule `json:"rules" yaml:"rules"`
+}
+
+// ScenarioRule matches requests by their attributes. All non-empty
+// attributes must match for the rule to be applied. A rule without
+// any attributes matches all requests.
+//
+// Matching requests are delayed by Delay and then responded to with Status
+// and Reason. Status 200 accepts the request without consulting any
+// further rules or case handlers. If Status is 0, the request is only
+// delayed and evaluation continues with the next rule. Latency
+// of matching requests replaces server's response time.
+type ScenarioRule struct {
+
+	// Name is an optional description of the rule.
+	Name string `json:"name,omitempty" yaml:"name"`
+
+	// DeviceToken matches device tokens exactly, ignoring case.
+	DeviceToken string `json:"device_token,omitempty" yaml:"device_token"`
+
+	// DeviceTokenPrefix matches device tokens starting with it, ignoring case.
+	DeviceTokenPrefix string `json:"device_token_prefix,omitempty" yaml:"device_token_prefix"`
+
+	// DeviceTokenRegex matches device tokens against regular expression.
+	DeviceTokenRegex string `json:"device_token_regex,omitempty" yaml:"device_token_regex"`
+
+	// Topic matches apns-topic header.
+	Topic string `json:"topic,omitempty" yaml:"topic"`
+
+	// PushType matches apns-push-type header.
+	PushType string `json:"push_type,omitempty" yaml:"push_type"`
+
+	// Priority matches apns-priority header.
+	Priority string `json:"priority,omitempty" yaml:"priority"`
+
+	// Team matches "iss" claim of JWT provider token.
+	Team string `json:"team,omitempty" yaml:"team"`
+
+	// Key matches "kid" header of JWT provider token.
+	Key string `json:"key,omitempty" yaml:"key"`
+
+	// Payload maps dot-separated paths into request payload to expected
+	// values, e.g. "aps.alert.title" or "aps.alert.loc-args.0". Values are
+	// compared by their textual representation. Null value matches any
+	// value as long as the path is present in the payload.
+	Payload map[string]interface{} `json:"payload,omitempty" yaml:"payload"`
+
+	// Status is the response status code. It must be 0, 200
+	// or between 400 and 599.
+	Status int `json:"status,omitempty" yaml:"status"`
+
+	// Reason is the rejection reason reported in the response.
+	Reason string `json:"reason,omitempty" yaml:"reason"`
+
+	// Delay is the amount of time by which the response is delayed,
+	// in the format accepted by time.ParseDuration.
+	Delay string `json:"delay,omitempty" yaml:"delay"`
+
+	// Latency is the distribution of response times in the format
+	// accepted by ParseLatency, e.g. "lognormal:20ms,0.5".
+	Latency string `json:"latency,omitempty" yaml:"latency"`
+}
+
+// LoadScenario reads scenario from the specified YAML or JSON file.
+func LoadScenario(path string) (*Scenario, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseScenario(b)
+}
+
+// ParseScenario parses scenario from YAML or JSON encoded data
+// and verifies that all of its rules are valid.
+func ParseScenario(data []byte) (*Scenario, error) {
+	res := &Scenario{}
+	var err error
+	if s := strings.TrimSpace(string(data)); strings.HasPrefix(s, "{") {
+		err = json.Unmarshal(data, res)
+	} else {
+		err = yaml.Unmarshal(data, res)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("apns2mock: invalid scenario: %v", err)
+	}
+	if _, err := res.Handlers(); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// Handlers compiles scenario rules into case handlers.
+func (s *Scenario) Handlers() ([]HadlerFunc, error) {
+	res := []HadlerFunc{}
+	for i, r := range s.Rules {
+		h, err := r.handler()
+		if err != nil {
+			return nil, fmt.Errorf("apns2mock: invalid scenario rule %v: %v", i+1, err)
+		}
+		res = append(res, h)
+	}
+	return res, nil
+}
+
+// CaseHandler compiles scenario rules into a CaseHandler. Requests
+// not matched by any rule are evaluated by fallback case handlers,
+// if any are supplied, and are accepted otherwise.
+func (s *Scenario) CaseHandler(fallback ...[]HadlerFunc) (*CaseHandler, error) {
+	hs, err := s.Handlers()
+	if err != nil {
+		return nil, err
+	}
+	return &CaseHandler{CaseHandlers: JoinHandlers(append([][]HadlerFunc{hs}, fallback...)...)}, nil
+}
+
+func (r ScenarioRule) handler() (HadlerFunc, error) {
+	var re *regexp.Regexp
+	if r.DeviceTokenRegex != "" {
+		var err error
+		if re, err = regexp.Compile(r.DeviceTokenRegex); err != nil {
+			return nil, err
+		}
+	}
+	var delay time.Duration
+	if r.Delay != "" {
+		var err error
+		if delay, err = time.ParseDuration(r.Delay); err != nil {
+			return nil, err
+		}
+	}
+	var lat Latency
+	if r.Latency != "" {
+		var err error
+		if lat, err = ParseLatency(r.Latency); err != nil {
+			return nil, err
+		}
+	}
+	if r.Status != 0 && r.Status != 200 && (r.Status < 400 || r.Status > 599) {
+		return nil, fmt.Errorf("invalid status %v, must be 200 or between 400 and 599", r.Status)
+	}
+	return func(req *APNSRequest) (int, string) {
+		if !r.matches(req, re) {
+			return 0, ""
+		}
+		if delay > 0 {
+			time.Sleep(delay)
+		}
+		if lat != nil {
+			req.Latency = lat
+		}
+		return r.Status, r.Reason
+	}, nil
+}
+
+func (r ScenarioRule) matches(req *APNSRequest, re *regexp.Regexp) bool {
+	dt := strings.ToLower(req.DeviceToken)
+	if r.DeviceToken != "" && dt != strings.ToLower(r.DeviceToken) {
+		return false
+	}
+	if r.DeviceTokenPrefix != "" && !strings.HasPrefix(dt, strings.ToLower(r.DeviceTokenPrefix)) {
+		return false
+	}
+	if re != nil && !re.MatchString(req.DeviceToken) {
+		return false
+	}
+	if r.Topic != "" && req.Header.Get("apns-topic") != r.Topic {
+		return false
+	}
+	if r.PushType != "" && req.Header.Get("apns-push-type") != r.PushType {
+		return false
+	}
+	if r.Priority != "" && req.Header.Get("apns-priority") != r.Priority {
+		return false
+	}
+	if r.Team != "" && stringValue(req.TokenClaims, "iss") != r.Team {
+		return false
+	}
+	if r.Key != "" && stringValue(req.TokenHeader, "kid") != r.Key {
+		return false
+	}
+	for p, ev := range r.Payload {
+		v, ok := payloadValue(req.Payload, p)
+		if !ok {
+			return false
+		}
+		if ev != nil && !payloadEqual(v, ev) {
+			return false
+		}
+	}
+	return true
+}
+
+// stringValue returns string value stored in m under key k or
+// empty string if there is no such value.
+func stringValue(m map[string]interface{}, k string) string {
+	s, _ := m[k].(string)
+	return s
+}
+
+// payloadEqual reports whether payload value v equals expected value ev.
+// Numbers are compared by value regardless of their type, since JSON
+// payload numbers are decoded as float64 while scenario numbers
+// may be integers.
+func payloadEqual(v, ev interface{}) bool {
+	if x, ok := numberValue(v); ok {
+		if y, ok := numberValue(ev); ok {
+			return x == y
+		}
+	}
+	return fmt.Sprint(v) == fmt.Sprint(ev)
+}
+
+// numberValue returns v as float64 if v is a number.
+func numberValue(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case float64:
+		return n, true
+	case float32:
+		return float64(n), true
+	case int:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case uint64:
+		return float64(n), true
+	case json.Number:
+		f, err := n.Float64()
+		return f, err == nil
+	}
+	return 0, false
+}
+
+// payloadValue returns the value found at the dot-separated path
+// in payload. Numeric path elements index into arrays.
+func payloadValue(payload map[string]interface{}, path string) (interface{}, bool) {
+	var v interface{} = payload
+	for _, e := range strings.Split(path, ".") {
+		switch c := v.(type) {
+		case map[string]interface{}:
+			var ok bool
+			if v, ok = c[e]; !ok {
+				return nil, false
+			}
+		case []interface{}:
+			i, err := strconv.Atoi(e)
+			if err != nil || i < 0 || i >= len(c) {
+				return nil, false
+			}
+			v = c[i]
+		default:
+			return nil, false
+		}
+	}
+	return v, true
+}
@@ -0,0 +1,199 @@
+// Copyright 2017 Aleksey Blinov. All rights reserved.
+
+package apns2mock
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Phase is a period of time during which the server responds to all requests
+// in the same way. Phases with status 0 or 200 handle requests normally.
+// Phases with other status codes reject all requests with the status
+// and reason. Schedule is kept separately from availability set with
+// BecomeUnavailable, SetFaultProfile or BecomeFaulty, which remains
+// in effect during healthy phases and is overridden by rejecting ones.
+type Phase struct {
+
+	// Duration is the length of the phase. Phase with zero duration
+	// lasts until the schedule is stopped.
+	Duration time.Duration `json:"duration"`
+
+	// Status is the response status code. It must be 0, 200
+	// or between 400 and 599.
+	Status int `json:"status"`
+
+	// Reason is the rejection reason reported in the response.
+	Reason string `json:"reason"`
+}
+
+// Schedule is a timeline of server availability changes, e.g. healthy
+// for 10 seconds, then 503 for 5 seconds, then 500 for 2 seconds:
+//
+//	apns2mock.Schedule{
+//		Phases: []apns2mock.Phase{
+//			{10 * time.Second, 0, ""},
+//			{5 * time.Second, 503, "ServiceUnavailable"},
+//			{2 * time.Second, 500, "InternalServerError"},
+//		},
+//	}
+//
+// Use Server.StartSchedule to run schedules.
+type Schedule struct {
+
+	// Phases lists phases in order of their appearance.
+	Phases []Phase `json:"phases"`
+
+	// Loop indicates that the schedule should start over once
+	// its last phase ends. Otherwise the server resumes normal
+	// request handling after the last phase.
+	Loop bool `json:"loop"`
+}
+
+// scheduleFile is the YAML and JSON representation of Schedule.
+type scheduleFile struct {
+	Loop   bool `json:"loop" yaml:"loop"`
+	Phases []struct {
+		Duration string `json:"duration" yaml:"duration"`
+		Status   int    `json:"status" yaml:"status"`
+		Reason   string `json:"reason" yaml:"reason"`
+	} `json:"phases" yaml:"phases"`
+}
+
+// LoadSchedule reads schedule from the specified YAML or JSON file:
+//
+//	loop: true
+//	phases:
+//	  - duration: 10s
+//	  - duration: 5s
+//	    status: 503
+//	    reason: ServiceUnavailable
+//	  - duration: 2s
+//	    status: 500
+//	    reason: InternalServerError
+func LoadSchedule(path string) (*Schedule, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseSchedule(b)
+}
+
+// ParseSchedule parses schedule from YAML or JSON encoded data.
+func ParseSchedule(data []byte) (*Schedule, error) {
+	var f scheduleFile
+	var err error
+	if s := strings.TrimSpace(string(data)); strings.HasPrefix(s, "{") {
+		err = json.Unmarshal(data, &f)
+	} else {
+		err = yaml.Unmarshal(data, &f)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("apns2mock: invalid schedule: %v", err)
+	}
+	res := &Schedule{Loop: f.Loop}
+	for i, p := range f.Phases {
+		var d time.Duration
+		if p.Duration != "" {
+			if d, err = time.ParseDuration(p.Duration); err != nil {
+				return nil, fmt.Errorf("apns2mock: invalid schedule phase %v: %v", i+1, err)
+			}
+		}
+		res.Phases = append(res.Phases, Phase{Duration: d, Status: p.Status, Reason: p.Reason})
+	}
+	if err := res.validate(); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+func (sc *Schedule) validate() error {
+	if len(sc.Phases) == 0 {
+		return errors.New("apns2mock: schedule has no phases")
+	}
+	for _, p := range sc.Phases {
+		if p.Duration < 0 {
+			return errors.New("apns2mock: negative schedule phase duration")
+		}
+		if p.Status != 0 && p.Status != 200 && (p.Status < 400 || p.Status > 599) {
+			return errors.New("apns2mock: schedule phase status must be 0, 200 or between 400 and 599")
+		}
+	}
+	return nil
+}
+
+// StartSchedule starts running the schedule in the background, stopping
+// the previously started schedule if there is one. Phase durations
+// are measured with server's clock.
+func (s *Server) StartSchedule(sc Schedule) error {
+	if err := sc.validate(); err != nil {
+		return err
+	}
+	sc.Phases = append([]Phase{}, sc.Phases...)
+	s.schedMu.Lock()
+	defer s.schedMu.Unlock()
+	s.stopSchedule()
+	s.schedStop = make(chan struct{})
+	s.schedDone = make(chan struct{})
+	go s.runSchedule(sc, s.Clock(), s.schedStop, s.schedDone)
+	return nil
+}
+
+// StopSchedule stops running schedule, if any. Availability set with
+// BecomeUnavailable, SetFaultProfile or BecomeFaulty is not affected.
+func (s *Server) StopSchedule() {
+	s.schedMu.Lock()
+	defer s.schedMu.Unlock()
+	s.stopSchedule()
+}
+
+func (s *Server) stopSchedule() {
+	if s.schedStop == nil {
+		return
+	}
+	close(s.schedStop)
+	<-s.schedDone
+	s.schedStop = nil
+	s.schedDone = nil
+	s.schedPhase.Store(Phase{})
+}
+
+func (s *Server) runSchedule(sc Schedule, clock Clock, stop, done chan struct{}) {
+	defer close(done)
+	for {
+		for _, p := range sc.Phases {
+			s.schedPhase.Store(p)
+			if p.Duration == 0 {
+				<-stop
+				return
+			}
+			select {
+			case <-stop:
+				return
+			case <-clock.After(p.Duration):
+			}
+		}
+		if !sc.Loop {
+			s.schedPhase.Store(Phase{})
+			return
+		}
+	}
+}
+
+// interceptSchedule rejects the request if current schedule phase
+// says so. It returns true if the request has been rejected.
+func (s *Server) interceptSchedule(w http.ResponseWriter) bool {
+	p, _ := s.schedPhase.Load().(Phase)
+	if p.Status == 0 || p.Status == 200 {
+		return false
+	}
+	respErr(w, p.Status, p.Reason)
+	return true
+}
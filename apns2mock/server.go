@@ -3,11 +3,15 @@
 package apns2mock
 
 import (
+	"context"
 	"crypto/tls"
 	"crypto/x509"
 	"errors"
+	"math/rand"
 	"net/http"
 	"net/http/httptest"
+	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 
@@ -35,6 +39,27 @@ type CommsCfg struct {
 	// ResponseTime is the time to be taken to respond to a request other than
 	// 404 BadPath response.
 	ResponseTime time.Duration
+
+	// Latency, if not nil, is the distribution of response times
+	// to use instead of fixed ResponseTime.
+	Latency Latency
+
+	// GoAwayAfterStreams, if not 0, makes server send graceful GOAWAY frame
+	// on connections once the client opens the specified number of streams.
+	GoAwayAfterStreams uint32
+
+	// GoAwayAfterAge, if not 0, makes server send graceful GOAWAY frame
+	// on connections that have been open for the specified amount of time.
+	GoAwayAfterAge time.Duration
+
+	// TLS contains TLS settings of the server. They cannot be changed
+	// once the server is started.
+	TLS TLSCfg
+
+	// HTTP2 contains HTTP/2 settings of the server other than
+	// MaxConcurrentStreams. They cannot be changed once the server
+	// is started. NewServer fails if they are out of range.
+	HTTP2 HTTP2Cfg
 }
 
 // TypicalCommsCfg contains settings that emulate typical latency and
@@ -69,18 +94,71 @@ const AutoKey = ""
 // on creating servers.
 type Server struct {
 
-	// We are wrapping httptest.Server in order to extend functionality
-	// and to backfill features missing in go 1.7.
+	// We are wrapping httptest.Server in order to extend functionality.
 	*httptest.Server
 
 	// RootCertificate to use when setting up client TLS's RootCAs.
+	// It is the certificate of auto-generated certificate authority
+	// or server's own certificate if one was loaded from file.
 	RootCertificate *tls.Certificate
 
 	// Preconfigured client. This supercedes httptest.Server's client
 	// in go 1.8 and later.
 	client *http.Client
 
+	// env is the environment the server emulates.
+	env Environment
+
 	interceptor *atomic.Value
+
+	// mu guards commsCfg, tokenResponses and clock.
+	mu             sync.Mutex
+	commsCfg       CommsCfg
+	tokenResponses map[string]TokenResponse
+	clock          Clock
+
+	handler  http.Handler
+	listener *cappedConnListener
+	recorder *recorder
+
+	expectations *expectations
+
+	admin *http.Server
+
+	// done is closed when the server is closed.
+	done      chan struct{}
+	closeOnce sync.Once
+
+	// ca is the certificate authority that issued auto-generated server
+	// certificate for certHosts, or nil if certificate was loaded from file.
+	ca        *certAuthority
+	certHosts []string
+
+	// tlsConfig is TLS configuration the server was started with.
+	tlsConfig *tls.Config
+
+	// hsMu guards handshake fault state.
+	hsMu       sync.Mutex
+	hsFaults   HandshakeFaults
+	hsRand     *rand.Rand
+	hsAttempts uint64
+	hsInjected uint64
+	hsCerts    map[HandshakeFault]tls.Certificate
+
+	// schedMu guards running schedule.
+	schedMu   sync.Mutex
+	schedStop chan struct{}
+	schedDone chan struct{}
+
+	// schedPhase is current Phase of running schedule.
+	schedPhase atomic.Value
+}
+
+// TokenResponse is a response the server sends to all requests for a device
+// token configured with Server.SetTokenResponse.
+type TokenResponse struct {
+	Status int    `json:"status"`
+	Reason string `json:"reason,omitempty"`
 }
 
 // NewServer creates and starts a new Server instance with handler servicing
@@ -88,73 +166,246 @@ type Server struct {
 // If certFile and keyFile are not empty, the server TLS certicicate will be
 // loaded from the specified files.
 //
-// If either certFile or keyFile is empty a new self-signed certificate
-// will be created. This is usually all that is needed for integrating
-// mock server in automated tests. Simply use server's pre-configured client
+// If either certFile or keyFile is empty a new certificate authority
+// will be created along with server certificate it issues for
+// commsCfg.TLS.CertHosts.
+// This is usually all that is needed for integrating mock server
+// in automated tests. Simply use server's pre-configured client
 // for your testing or retrieve server's URL and root certificate to configure
 // your custom client.
+//
+// The server requests TLS client certificates but does not require them.
+// Presented certificates are made available to case handlers
+// in APNSRequest. See NewCertHandlers for more information.
 func NewServer(commsCfg CommsCfg, handler http.Handler, certFile string, keyFile string) (*Server, error) {
 	if handler == nil {
 		return nil, errors.New("apns2mock: no handler supplied.")
 	}
-	mux := http.NewServeMux()
-	itcpr := &atomic.Value{}
-	tryIntercept := func(w http.ResponseWriter) bool {
-		if ihi := itcpr.Load(); ihi != nil {
-			ih := ihi.(func(w http.ResponseWriter) bool)
-			return ih(w)
-		}
-		return false
+	if err := commsCfg.HTTP2.validate(); err != nil {
+		return nil, err
 	}
-	mux.HandleFunc(RequestRoot, func(w http.ResponseWriter, r *http.Request) {
-		if tryIntercept(w) {
-			return
-		}
-		if commsCfg.ResponseTime > 0 {
-			time.Sleep(commsCfg.ResponseTime)
-		}
-		handler.ServeHTTP(w, r)
-	})
+	res := &Server{
+		interceptor:  &atomic.Value{},
+		done:         make(chan struct{}),
+		commsCfg:     commsCfg,
+		clock:        SystemClock,
+		handler:      handler,
+		recorder:     &recorder{},
+		expectations: &expectations{},
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc(RequestRoot, res.serveRoot)
 	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		if tryIntercept(w) {
+		if res.intercept(w, r) {
 			return
 		}
 		writeApnsId(w, r)
 		respErr(w, 404, "BadPath")
 	})
 	srv := httptest.NewUnstartedServer(mux)
-	srv.Listener = &cappedConnListener{
+	res.listener = &cappedConnListener{
 		Listener: srv.Listener,
 		Cap:      commsCfg.MaxConns,
 		Delay:    commsCfg.ConnectionDelay,
+		Now:      func() time.Time { return res.Clock().Now() },
 	}
+	srv.Listener = res.listener
 	http2Conf := &http2.Server{
 		MaxConcurrentStreams: commsCfg.MaxConcurrentStreams,
 	}
+	commsCfg.HTTP2.apply(srv.Config, http2Conf)
 	if err := http2.ConfigureServer(srv.Config, http2Conf); err != nil {
 		return nil, err
 	}
-	srv.TLS = &tls.Config{
-		CipherSuites: []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256},
-		NextProtos:   []string{http2.NextProtoTLS},
+	// HTTP/2 connections are wrapped so that frames http2.Server
+	// has no API for can be injected.
+	srv.Config.TLSNextProto[http2.NextProtoTLS] = func(hs *http.Server, c *tls.Conn, h http.Handler) {
+		opts := &http2.ServeConnOpts{Handler: h, BaseConfig: hs}
+		// The per-connection base context is passed down by net/http
+		// via handler's unadvertised BaseContext method.
+		if bc, ok := h.(interface {
+			BaseContext() context.Context
+		}); ok {
+			opts.Context = bc.BaseContext()
+		}
+		http2Conf.ServeConn(res.listener.newH2Conn(c, commsCfg), opts)
 	}
+	srv.TLS = commsCfg.TLS.config()
+	// Client certificates are validated by case handlers so that
+	// bad certificates can be rejected with APNS-style reasons.
+	srv.TLS.ClientAuth = tls.RequestClientCert
+	srv.TLS.GetConfigForClient = res.configForClient
 	if certFile != "" && keyFile != "" {
 		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
 		if err != nil {
 			return nil, err
 		}
 		srv.TLS.Certificates = []tls.Certificate{cert}
+	} else {
+		ca, err := newCertAuthority("APNS Mock CA")
+		if err != nil {
+			return nil, err
+		}
+		now := time.Now()
+		hosts := autoCertHosts(commsCfg.TLS.CertHosts, srv.Listener.Addr())
+		cert, err := ca.issue(hosts, now.Add(-time.Hour), now.Add(365*24*time.Hour))
+		if err != nil {
+			return nil, err
+		}
+		srv.TLS.Certificates = []tls.Certificate{cert}
+		res.RootCertificate = ca.tlsCertificate()
+		res.ca, res.certHosts = ca, hosts
 	}
+	res.tlsConfig = srv.TLS
 	srv.StartTLS()
-	res := &Server{
-		Server:          srv,
-		RootCertificate: &srv.TLS.Certificates[0],
-		client:          makeClient(&srv.TLS.Certificates[0]),
-		interceptor:     itcpr,
+	res.Server = srv
+	if res.RootCertificate == nil {
+		res.RootCertificate = &srv.TLS.Certificates[0]
 	}
+	res.client = makeClient(res.RootCertificate)
 	return res, nil
 }
 
+// serveRoot serves all requests on RequestRoot path recording
+// them along with the responses.
+func (s *Server) serveRoot(w http.ResponseWriter, r *http.Request) {
+	env := &requestEnv{
+		clock:  s.Clock(),
+		conn:   s.listener.conn(r.RemoteAddr),
+		stream: h2StreamID(w),
+		done:   s.done,
+	}
+	r = r.WithContext(context.WithValue(r.Context(), requestEnvKey{}, env))
+	n := newNotification(r, env.clock.Now(), s.payloadLimit(r.Header.Get("apns-push-type")))
+	if env.conn != nil {
+		n.ConnID = env.conn.id
+		env.conn.begin()
+	}
+	rw := &recordingWriter{ResponseWriter: w}
+	// Requests failed with network faults abort the handler,
+	// so they are recorded on the way out.
+	defer func() {
+		if env.conn != nil {
+			env.conn.end(&n)
+		}
+		rw.record(&n)
+		if env.fault != NoNetFault {
+			n.NetFault = env.fault
+			n.Status = rw.status
+		}
+		s.recorder.add(n)
+	}()
+	s.serveNotification(rw, r, &n)
+}
+
+// payloadLimit returns maximum payload size for the specified push type
+// enforced by server's handler.
+func (s *Server) payloadLimit(pushType string) int {
+	if h, ok := s.handler.(*CaseHandler); ok {
+		return h.payloadLimit(pushType)
+	}
+	return (&CaseHandler{}).payloadLimit(pushType)
+}
+
+// requestEnv makes server's state available to handlers
+// serving a request through request context.
+type requestEnv struct {
+	clock Clock
+
+	// conn is the connection the request was received on.
+	conn *netConn
+
+	// stream is the ID of HTTP/2 stream the request was received on,
+	// or 0 if it is not known.
+	stream uint32
+
+	// done is closed when the server is closed.
+	done <-chan struct{}
+
+	// fault is set to network fault the request is failed with.
+	fault NetFaultMode
+
+	// delay is the time the response is to take.
+	delay time.Duration
+}
+
+// requestEnvKey is request context key under which requestEnv is stored.
+type requestEnvKey struct{}
+
+// requestEnvOf returns environment of request r or nil
+// if r is not served by Server.
+func requestEnvOf(r *http.Request) *requestEnv {
+	env, _ := r.Context().Value(requestEnvKey{}).(*requestEnv)
+	return env
+}
+
+// serveNotification passes request to server's handler unless
+// it is intercepted or responded to by a matching expectation.
+func (s *Server) serveNotification(w http.ResponseWriter, r *http.Request, n *Notification) {
+	if s.intercept(w, r) {
+		return
+	}
+	s.mu.Lock()
+	rt, lat := s.commsCfg.ResponseTime, s.commsCfg.Latency
+	tr, hasTR := s.tokenResponses[strings.ToLower(n.DeviceToken)]
+	s.mu.Unlock()
+	if env := requestEnvOf(r); env != nil {
+		env.delay = rt
+		if lat != nil {
+			env.delay = lat.Next()
+		}
+		// Response is delayed until it is written so that case handlers
+		// have a chance to override response time.
+		w = &delayingWriter{ResponseWriter: w, env: env, started: time.Now()}
+	}
+	if hasTR {
+		writeApnsId(w, r)
+		if tr.Status == 200 {
+			respSucc(w)
+		} else {
+			respErr(w, tr.Status, tr.Reason)
+		}
+		return
+	}
+	// Requests answered with token responses do not count
+	// towards expectations.
+	if e := s.expectations.match(n); e != nil && e.serve(w, r) {
+		return
+	}
+	s.handler.ServeHTTP(w, r)
+}
+
+// intercept gives server's interceptor a chance to respond to the request.
+// It returns true if the request has been handled by the interceptor.
+func (s *Server) intercept(w http.ResponseWriter, r *http.Request) bool {
+	if s.interceptSchedule(w) {
+		return true
+	}
+	if ihi := s.interceptor.Load(); ihi != nil {
+		ih := ihi.(func(w http.ResponseWriter, r *http.Request) bool)
+		return ih(w, r)
+	}
+	return false
+}
+
+// SendGoAway sends GOAWAY frame with the specified error code and debug data
+// on connections with the specified IDs, or on all open connections if no IDs
+// are specified. Connection IDs are reported in Notification.ConnID.
+// It returns the number of connections GOAWAY was sent on.
+//
+// Use http2.ErrCodeNo for graceful GOAWAY. Server does not close
+// connections after sending GOAWAY and continues serving streams
+// the client has already opened.
+func (s *Server) SendGoAway(code http2.ErrCode, debugData []byte, connIDs ...uint64) int {
+	res := 0
+	for _, c := range s.listener.h2Conns(connIDs...) {
+		if c.sendGoAway(code, debugData) == nil {
+			res++
+		}
+	}
+	return res
+}
+
 // Client returns an HTTP client configured for making requests to the server.
 // It is configured to trust the server's TLS test certificate and will close
 // its idle connections on Server.Close.
@@ -166,7 +417,7 @@ func (s *Server) Client() *http.Client {
 // and reason to any future requests. This is typically used to test handling
 // of 5XX status codes by clients.
 func (s *Server) BecomeUnavailable(statusCode int, reason string) {
-	s.interceptor.Store(func(w http.ResponseWriter) bool {
+	s.interceptor.Store(func(w http.ResponseWriter, r *http.Request) bool {
 		respErr(w, statusCode, reason)
 		return true
 	})
@@ -174,14 +425,156 @@ func (s *Server) BecomeUnavailable(statusCode int, reason string) {
 
 // BecomeAvailable restores normal request handling flow.
 func (s *Server) BecomeAvailable() {
-	s.interceptor.Store(func(w http.ResponseWriter) bool {
+	s.interceptor.Store(func(w http.ResponseWriter, r *http.Request) bool {
 		return false
 	})
 }
 
+// Environment returns APNS environment emulated by the server.
+// It is AnyEnvironment unless the server is a part of EnvironmentPair.
+func (s *Server) Environment() Environment {
+	return s.env
+}
+
+// Clock returns the clock used by the server.
+func (s *Server) Clock() Clock {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.clock
+}
+
+// SetClock makes server and its case handlers use clock c as the source
+// of current time for future requests and schedules. See Clock for more
+// information. Server uses SystemClock by default.
+func (s *Server) SetClock(c Clock) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if c == nil {
+		c = SystemClock
+	}
+	s.clock = c
+}
+
+// CommsCfg returns current communications settings of the server.
+func (s *Server) CommsCfg() CommsCfg {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.commsCfg
+}
+
+// SetConnectionDelay changes the amount of time by which accepting
+// of future client connections is delayed.
+func (s *Server) SetConnectionDelay(d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.commsCfg.ConnectionDelay = d
+	s.listener.setDelay(d)
+}
+
+// SetResponseTime changes the time taken to respond to future requests.
+// It removes latency distribution set with SetLatency.
+func (s *Server) SetResponseTime(d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.commsCfg.ResponseTime = d
+	s.commsCfg.Latency = nil
+}
+
+// SetLatency makes server choose time taken to respond to future requests
+// from distribution l. Passing nil restores fixed response time.
+func (s *Server) SetLatency(l Latency) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.commsCfg.Latency = l
+}
+
+// SetTokenResponse makes server respond to all future requests for
+// the specified device token with the specified status code and reason,
+// bypassing server's handler. Use status 200 for successful responses.
+func (s *Server) SetTokenResponse(token string, status int, reason string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.tokenResponses == nil {
+		s.tokenResponses = map[string]TokenResponse{}
+	}
+	s.tokenResponses[strings.ToLower(token)] = TokenResponse{Status: status, Reason: reason}
+}
+
+// TokenResponses returns all responses configured with SetTokenResponse
+// keyed by device token.
+func (s *Server) TokenResponses() map[string]TokenResponse {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	res := map[string]TokenResponse{}
+	for k, v := range s.tokenResponses {
+		res[k] = v
+	}
+	return res
+}
+
+// ClearTokenResponse removes response configured for the specified
+// device token with SetTokenResponse.
+func (s *Server) ClearTokenResponse(token string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.tokenResponses, strings.ToLower(token))
+}
+
+// ClearTokenResponses removes all responses configured with SetTokenResponse.
+func (s *Server) ClearTokenResponses() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tokenResponses = nil
+}
+
+// Stats contains request and connection counters of the server.
+type Stats struct {
+
+	// Received is the number of notifications received since the server
+	// was started or since the last call to Reset.
+	Received int `json:"received"`
+
+	// Statuses counts received notifications by response status code.
+	Statuses map[int]int `json:"statuses"`
+
+	// Connections is the number of currently open client connections.
+	Connections int `json:"connections"`
+
+	// TotalConnections is the number of client connections accepted
+	// since the server was started.
+	TotalConnections uint64 `json:"total_connections"`
+
+	// HandshakeFaults is the number of connection attempts failed
+	// with injected TLS handshake faults since the server was started.
+	HandshakeFaults uint64 `json:"handshake_faults"`
+}
+
+// Stats returns current request and connection counters.
+func (s *Server) Stats() Stats {
+	var res Stats
+	res.Received, res.Statuses = s.recorder.counts()
+	res.Connections, res.TotalConnections = s.listener.counts()
+	s.hsMu.Lock()
+	res.HandshakeFaults = s.hsInjected
+	s.hsMu.Unlock()
+	return res
+}
+
+// Close stops running schedule and shuts down the server along with
+// its admin API listener, if one was started, and blocks until all
+// outstanding requests on the server have completed. Requests left
+// hanging by Hang network faults are aborted.
+func (s *Server) Close() {
+	s.closeOnce.Do(func() { close(s.done) })
+	s.StopSchedule()
+	s.closeAdmin()
+	s.Server.Close()
+}
+
 func makeClient(cert *tls.Certificate) *http.Client {
-	// httptest.Server.Certificate() is not available in go 1.7,
-	// so we must to it the hard way.
+	// httptest.Server.Certificate() returns server's own certificate,
+	// while clients must trust cert, which may be the root certificate
+	// of auto-generated certificate authority.
 	// This will not error out as the same cert was just parsed
 	// while creating the server.
 	rCert, _ := x509.ParseCertificate(cert.Certificate[0])
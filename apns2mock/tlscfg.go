@@ -0,0 +1,67 @@
+// Copyright 2017 Aleksey Blinov. All rights reserved.
+
+package apns2mock
+
+import (
+	"crypto/tls"
+
+	"golang.org/x/net/http2"
+)
+
+// TLSCfg contains TLS settings of the server. Zero values select
+// the defaults.
+type TLSCfg struct {
+
+	// MinVersion and MaxVersion limit TLS versions accepted by the server,
+	// e.g. tls.VersionTLS12. If 0, crypto/tls defaults are used.
+	MinVersion uint16
+	MaxVersion uint16
+
+	// CipherSuites lists cipher suites enabled for TLS 1.2 and earlier.
+	// TLS 1.3 cipher suites are not configurable. If empty,
+	// TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256 and
+	// TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256 are enabled.
+	CipherSuites []uint16
+
+	// CurvePreferences lists elliptic curves used in ECDHE handshakes.
+	// If empty, crypto/tls defaults are used.
+	CurvePreferences []tls.CurveID
+
+	// NextProtos lists ALPN protocols offered by the server. If empty,
+	// only "h2" is offered. Connections negotiating "http/1.1" are
+	// served over HTTP/1.1, while clients that require "h2" fail
+	// to connect if it is not offered.
+	NextProtos []string
+
+	// CertHosts lists host names and IP addresses that auto-generated
+	// server certificate is issued for. The IP address the server
+	// listens on is always included. If empty, DefaultCertHosts are used.
+	CertHosts []string
+}
+
+// DefaultCipherSuites are cipher suites enabled unless TLSCfg specifies
+// otherwise.
+var DefaultCipherSuites = []uint16{
+	tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+}
+
+// config returns server TLS configuration described by c.
+func (c TLSCfg) config() *tls.Config {
+	res := &tls.Config{
+		MinVersion:   c.MinVersion,
+		MaxVersion:   c.MaxVersion,
+		CipherSuites: append([]uint16{}, c.CipherSuites...),
+		NextProtos:   append([]string{}, c.NextProtos...),
+	}
+	if len(res.CipherSuites) == 0 {
+		res.CipherSuites = append(res.CipherSuites, DefaultCipherSuites...)
+	}
+	if len(c.CurvePreferences) > 0 {
+		res.CurvePreferences = append([]tls.CurveID{}, c.CurvePreferences...)
+	}
+	if len(res.NextProtos) == 0 {
+		res.NextProtos = []string{http2.NextProtoTLS}
+	}
+	return res
+}
@@ -11,31 +11,84 @@
 //
 //   -addr address
 //     	network address to serve on (default "127.0.0.1:8443")
+//   -admin address
+//     	network address to serve plain HTTP admin API on; admin API is disabled if not set
 //   -allok
 //     	if allok is true, server will respond with 200 status to all requests
+//   -alpn protocols
+//     	comma separated ALPN protocols offered to clients; clients requiring h2 fail to connect if it is not offered (default "h2")
 //   -cert path
-//     	path to server TLS certificate (default "certs/server.crt")
+//     	path to server TLS certificate; certificate is auto-generated if either -cert or -key is empty (default "certs/server.crt")
+//   -cert-hosts hosts
+//     	comma separated hosts auto-generated server certificate is issued for (default "localhost,127.0.0.1,::1,api.sandbox.push.apple.com,api.development.push.apple.com,api.push.apple.com")
+//   -client-ca path
+//     	path to PEM encoded CA certificates for verifying TLS client certificates
 //   -conn-delay time
 //     	amount of time by which client connect attempts should be delayed (default 100ms)
 //   -conns number
 //     	maximum number of concurrent HTTP/2 connections (default 5)
+//   -devices path
+//     	path to JSON file with known device tokens; if not set, device tokens are evaluated by predefined rules
+//   -goaway-age time
+//     	time after which graceful GOAWAY is sent on connections; GOAWAY is not sent if not set
+//   -goaway-streams number
+//     	number of streams on a connection after which graceful GOAWAY is sent; GOAWAY is not sent if not set
+//   -h2-conn-window bytes
+//     	HTTP/2 connection flow control window in bytes for data sent by clients, no less than 65535
+//   -h2-idle-timeout time
+//     	time after which idle HTTP/2 connections are closed with GOAWAY; connections are not closed if not set
+//   -h2-max-frame bytes
+//     	size in bytes of largest HTTP/2 frame clients may send, between 16384 and 16777215
+//   -h2-max-header-list bytes
+//     	maximum size in bytes of request headers advertised to and enforced on clients
+//   -h2-settings settings
+//     	comma separated NAME=VALUE HTTP/2 settings advertised to clients without being enforced, e.g. MAX_CONCURRENT_STREAMS=1000; names may also be numeric setting IDs
+//   -h2-window bytes
+//     	HTTP/2 stream flow control window in bytes for data sent by clients
+//   -handshake-fault spec
+//     	TLS handshake fault injected into connection attempts, one of expired-cert, wrong-host, untrusted-issuer, stall or alert, optionally followed by /N for every Nth attempt or /P% for P percent of them
 //   -key path
 //     	path to TLS certificate key (default "certs/server.key")
-//   -resp-delay time
-//     	amount of time by which responses should be delayed (default 5ms)
+//   -provider-key team:key:path
+//     	team ID, key ID and path to .p8 file of provider token signing key; can be repeated
+//   -record-limit number
+//     	maximum number of most recent notifications kept for inspection; 0 keeps all and negative disables recording (default 10000)
+//   -resp-delay spec
+//     	response time as a fixed duration or as distribution spec, e.g. normal:20ms,5ms or lognormal:20ms,0.5+spikes:1%,2s (default "5ms")
+//   -root-cert-out path
+//     	path to write PEM encoded root certificate to; clients must trust it if server certificate is auto-generated
+//   -scenario path
+//     	path to YAML or JSON scenario file with rules evaluated ahead of all other request handling rules
+//   -schedule path
+//     	path to YAML or JSON file with availability schedule to run once the server is started
 //   -streams number
 //     	number of concurrent HTTP/2 streams (default 500)
+//   -tls-ciphers names
+//     	comma separated names of cipher suites enabled for TLS 1.2 and earlier, e.g. TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256
+//   -tls-curves names
+//     	comma separated names of elliptic curves in order of preference, from X25519, P256, P384 and P521
+//   -tls-max version
+//     	maximum TLS version accepted, one of 1.0, 1.1, 1.2 or 1.3
+//   -tls-min version
+//     	minimum TLS version accepted, one of 1.0, 1.1, 1.2 or 1.3
 //   -verbose
 //     	if true, verbose enables http2 verbose logging
 package main
 
 import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"log"
+	"math"
 	"net"
 	"net/http"
 	"os"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/baobabus/go-apnsmock/apns2mock"
@@ -50,6 +103,7 @@ Usage:
   go-apnsmock <flags>
 
 Flags:
+
 `
 
 // loopbackAddr returns loopback interface IP address as a string or empty
@@ -91,21 +145,185 @@ func loopbackAddr() string {
 	return ""
 }
 
+// providerKeyFlags collects repeated -provider-key flags.
+type providerKeyFlags []string
+
+func (f *providerKeyFlags) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *providerKeyFlags) Set(v string) error {
+	if len(strings.SplitN(v, ":", 3)) != 3 {
+		return errors.New("expected team:key:path")
+	}
+	*f = append(*f, v)
+	return nil
+}
+
+// loadProviderKeys loads provider token signing keys specified
+// by -provider-key flags.
+func loadProviderKeys(f providerKeyFlags) (*apns2mock.ProviderKeys, error) {
+	res := apns2mock.NewProviderKeys()
+	for _, v := range f {
+		p := strings.SplitN(v, ":", 3)
+		if err := res.LoadP8File(p[0], p[1], p[2]); err != nil {
+			return nil, err
+		}
+	}
+	return res, nil
+}
+
+// loadCertPool loads PEM encoded certificates from the specified file.
+func loadCertPool(path string) (*x509.CertPool, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	res := x509.NewCertPool()
+	if !res.AppendCertsFromPEM(b) {
+		return nil, errors.New("no certificates found in " + path)
+	}
+	return res, nil
+}
+
+// tlsVersions maps TLS version names accepted by -tls-min and -tls-max
+// flags to crypto/tls version constants.
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// tlsCurves maps curve names accepted by -tls-curves flag
+// to crypto/tls curve IDs.
+var tlsCurves = map[string]tls.CurveID{
+	"X25519": tls.X25519,
+	"P256":   tls.CurveP256,
+	"P384":   tls.CurveP384,
+	"P521":   tls.CurveP521,
+}
+
+// splitList splits comma separated list ignoring empty items.
+func splitList(s string) []string {
+	res := []string{}
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			res = append(res, v)
+		}
+	}
+	return res
+}
+
+// parseHTTP2Settings parses comma separated NAME=VALUE HTTP/2 settings.
+// Names are either setting names, such as MAX_FRAME_SIZE, or numeric
+// setting IDs.
+func parseHTTP2Settings(s string) ([]http2.Setting, error) {
+	names := map[string]http2.SettingID{}
+	for id := http2.SettingID(1); id < 10; id++ {
+		names[id.String()] = id
+	}
+	var res []http2.Setting
+	for _, v := range splitList(s) {
+		i := strings.Index(v, "=")
+		if i < 0 {
+			return nil, fmt.Errorf("invalid HTTP/2 setting %v", v)
+		}
+		name := strings.TrimSpace(v[:i])
+		id, ok := names[name]
+		if !ok {
+			n, err := strconv.ParseUint(name, 0, 16)
+			if err != nil {
+				return nil, fmt.Errorf("unknown HTTP/2 setting %v", name)
+			}
+			id = http2.SettingID(n)
+		}
+		val, err := strconv.ParseUint(strings.TrimSpace(v[i+1:]), 0, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value of HTTP/2 setting %v", name)
+		}
+		res = append(res, http2.Setting{ID: id, Val: uint32(val)})
+	}
+	return res, nil
+}
+
+// parseTLSCfg creates TLS settings from -tls-* and -alpn flag values.
+func parseTLSCfg(minVersion, maxVersion, ciphers, curves, alpn string) (apns2mock.TLSCfg, error) {
+	var res apns2mock.TLSCfg
+	for _, v := range []struct {
+		name string
+		dst  *uint16
+	}{{minVersion, &res.MinVersion}, {maxVersion, &res.MaxVersion}} {
+		if v.name == "" {
+			continue
+		}
+		ver, ok := tlsVersions[v.name]
+		if !ok {
+			return res, fmt.Errorf("unknown TLS version %v", v.name)
+		}
+		*v.dst = ver
+	}
+	suites := map[string]uint16{}
+	for _, cs := range append(tls.CipherSuites(), tls.InsecureCipherSuites()...) {
+		suites[cs.Name] = cs.ID
+	}
+	for _, name := range splitList(ciphers) {
+		id, ok := suites[name]
+		if !ok {
+			return res, fmt.Errorf("unknown cipher suite %v", name)
+		}
+		res.CipherSuites = append(res.CipherSuites, id)
+	}
+	for _, name := range splitList(curves) {
+		id, ok := tlsCurves[name]
+		if !ok {
+			return res, fmt.Errorf("unknown curve %v", name)
+		}
+		res.CurvePreferences = append(res.CurvePreferences, id)
+	}
+	res.NextProtos = splitList(alpn)
+	return res, nil
+}
+
 func main() {
 
 	lb := loopbackAddr()
 	fs := flag.NewFlagSet(os.Args[0], flag.ExitOnError)
 	addr := fs.String("addr", lb+":8443", "network `address` to serve on")
-	certFile := fs.String("cert", "certs/server.crt", "`path` to server TLS certificate")
+	adminAddr := fs.String("admin", "", "network `address` to serve plain HTTP admin API on; admin API is disabled if not set")
+	certFile := fs.String("cert", "certs/server.crt", "`path` to server TLS certificate; certificate is auto-generated if either -cert or -key is empty")
+	certHosts := fs.String("cert-hosts", strings.Join(apns2mock.DefaultCertHosts, ","), "comma separated `hosts` auto-generated server certificate is issued for")
+	rootCertOut := fs.String("root-cert-out", "", "`path` to write PEM encoded root certificate to; clients must trust it if server certificate is auto-generated")
 	keyFile := fs.String("key", "certs/server.key", "`path` to TLS certificate key")
+	clientCA := fs.String("client-ca", "", "`path` to PEM encoded CA certificates for verifying TLS client certificates")
+	var pkeys providerKeyFlags
+	fs.Var(&pkeys, "provider-key", "`team:key:path` - team ID, key ID and path to .p8 file of provider token signing key; can be repeated")
+	devices := fs.String("devices", "", "`path` to JSON file with known device tokens; if not set, device tokens are evaluated by predefined rules")
+	scenario := fs.String("scenario", "", "`path` to YAML or JSON scenario file with rules evaluated ahead of all other request handling rules")
+	schedule := fs.String("schedule", "", "`path` to YAML or JSON file with availability schedule to run once the server is started")
 	allOk := fs.Bool("allok", false, "if allok is true, server will respond with 200 status to all requests")
 	verbose := fs.Bool("verbose", false, "if true, verbose enables http2 verbose logging")
 	streams := fs.Uint("streams", 500, "`number` of concurrent HTTP/2 streams")
 	conns := fs.Uint("conns", 5, "maximum `number` of concurrent HTTP/2 connections")
 	cdelay := fs.Duration("conn-delay", 100*time.Millisecond, "amount of `time` by which client connect attempts should be delayed")
-	rdelay := fs.Duration("resp-delay", 5*time.Millisecond, "amount of `time` by which responses should be delayed")
+	tlsMin := fs.String("tls-min", "", "minimum TLS `version` accepted, one of 1.0, 1.1, 1.2 or 1.3")
+	tlsMax := fs.String("tls-max", "", "maximum TLS `version` accepted, one of 1.0, 1.1, 1.2 or 1.3")
+	tlsCiphers := fs.String("tls-ciphers", "", "comma separated `names` of cipher suites enabled for TLS 1.2 and earlier, e.g. TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256")
+	tlsCurvesFlag := fs.String("tls-curves", "", "comma separated `names` of elliptic curves in order of preference, from X25519, P256, P384 and P521")
+	alpn := fs.String("alpn", "h2", "comma separated ALPN `protocols` offered to clients; clients requiring h2 fail to connect if it is not offered")
+	h2Window := fs.Uint("h2-window", 0, "HTTP/2 stream flow control window in `bytes` for data sent by clients")
+	h2ConnWindow := fs.Uint("h2-conn-window", 0, "HTTP/2 connection flow control window in `bytes` for data sent by clients, no less than 65535")
+	h2MaxFrame := fs.Uint("h2-max-frame", 0, "size in `bytes` of largest HTTP/2 frame clients may send, between 16384 and 16777215")
+	h2MaxHeaderList := fs.Uint("h2-max-header-list", 0, "maximum size in `bytes` of request headers advertised to and enforced on clients")
+	h2IdleTimeout := fs.Duration("h2-idle-timeout", 0, "`time` after which idle HTTP/2 connections are closed with GOAWAY; connections are not closed if not set")
+	h2Settings := fs.String("h2-settings", "", "comma separated NAME=VALUE HTTP/2 `settings` advertised to clients without being enforced, e.g. MAX_CONCURRENT_STREAMS=1000; names may also be numeric setting IDs")
+	handshakeFault := fs.String("handshake-fault", "", "TLS handshake fault injected into connection attempts, one of expired-cert, wrong-host, untrusted-issuer, stall or alert, optionally followed by /N for every Nth attempt or /P% for P percent of them")
+	goAwayStreams := fs.Uint("goaway-streams", 0, "`number` of streams on a connection after which graceful GOAWAY is sent; GOAWAY is not sent if not set")
+	goAwayAge := fs.Duration("goaway-age", 0, "`time` after which graceful GOAWAY is sent on connections; GOAWAY is not sent if not set")
+	recordLimit := fs.Int("record-limit", 10000, "maximum `number` of most recent notifications kept for inspection; 0 keeps all and negative disables recording")
+	rdelay := fs.String("resp-delay", "5ms", "response time as a fixed duration or as distribution `spec`, e.g. normal:20ms,5ms or lognormal:20ms,0.5+spikes:1%,2s")
 	usage := func() {
-		fmt.Fprintln(os.Stderr, usageStr)
+		fmt.Fprint(os.Stderr, usageStr)
 		fs.PrintDefaults()
 	}
 	fs.Usage = usage
@@ -119,19 +337,117 @@ func main() {
 	}
 
 	flag.Set("httptest.serve", *addr)
+	latency, err := apns2mock.ParseLatency(*rdelay)
+	if err != nil {
+		log.Fatal(err)
+	}
+	tlsCfg, err := parseTLSCfg(*tlsMin, *tlsMax, *tlsCiphers, *tlsCurvesFlag, *alpn)
+	if err != nil {
+		log.Fatal(err)
+	}
+	h2Advertised, err := parseHTTP2Settings(*h2Settings)
+	if err != nil {
+		log.Fatal(err)
+	}
+	for name, v := range map[string]uint{"h2-window": *h2Window, "h2-conn-window": *h2ConnWindow, "h2-max-frame": *h2MaxFrame, "h2-max-header-list": *h2MaxHeaderList} {
+		if v > math.MaxUint32 {
+			log.Fatalf("-%v %v is out of range", name, v)
+		}
+	}
 	commsCfg := apns2mock.CommsCfg{
 		MaxConcurrentStreams: uint32(*streams),
 		MaxConns:             uint32(*conns),
 		ConnectionDelay:      *cdelay,
-		ResponseTime:         *rdelay,
+		Latency:              latency,
+		GoAwayAfterStreams:   uint32(*goAwayStreams),
+		GoAwayAfterAge:       *goAwayAge,
+		TLS:                  tlsCfg,
+		HTTP2: apns2mock.HTTP2Cfg{
+			InitialWindowSize:     uint32(*h2Window),
+			InitialConnWindowSize: uint32(*h2ConnWindow),
+			MaxFrameSize:          uint32(*h2MaxFrame),
+			MaxHeaderListSize:     uint32(*h2MaxHeaderList),
+			IdleTimeout:           *h2IdleTimeout,
+			Settings:              h2Advertised,
+		},
 	}
 	http2.VerboseLogs = *verbose
-	var handler http.Handler = apns2mock.DefaultHandler
-	if *allOk {
-		handler = apns2mock.AllOkayHandler
+	var handler http.Handler = apns2mock.AllOkayHandler
+	if !*allOk {
+		deviceHandlers := apns2mock.DeviceTokenHandlers
+		certHandlers := apns2mock.CertHandlers
+		if *devices != "" {
+			reg, err := apns2mock.LoadDeviceRegistry(*devices)
+			if err != nil {
+				log.Fatal(err)
+			}
+			deviceHandlers = apns2mock.NewDeviceHandlers(reg, apns2mock.AnyEnvironment)
+		}
+		if *clientCA != "" {
+			roots, err := loadCertPool(*clientCA)
+			if err != nil {
+				log.Fatal(err)
+			}
+			certHandlers = apns2mock.NewCertHandlers(roots, apns2mock.AnyEnvironment)
+		}
+		ch := &apns2mock.CaseHandler{
+			CaseHandlers: apns2mock.JoinHandlers(
+				apns2mock.HeaderHandlers,
+				apns2mock.PushTypeHandlers,
+				deviceHandlers,
+				apns2mock.NewAuthHandlers(apns2mock.AuthTokenHandlers, certHandlers),
+			),
+		}
+		if len(pkeys) > 0 {
+			keys, err := loadProviderKeys(pkeys)
+			if err != nil {
+				log.Fatal(err)
+			}
+			ch.ProviderKeys = keys
+		}
+		handler = ch
+	}
+	if *scenario != "" {
+		sc, err := apns2mock.LoadScenario(*scenario)
+		if err != nil {
+			log.Fatal(err)
+		}
+		// Requests not matched by scenario rules are handled as usual.
+		var fallback []apns2mock.HadlerFunc
+		var keys *apns2mock.ProviderKeys
+		if ch, ok := handler.(*apns2mock.CaseHandler); ok {
+			fallback = ch.CaseHandlers
+			keys = ch.ProviderKeys
+		}
+		sh, err := sc.CaseHandler(fallback)
+		if err != nil {
+			log.Fatal(err)
+		}
+		sh.ProviderKeys = keys
+		handler = sh
 	}
 
-	fmt.Fprintf(os.Stderr, "Using certificate %#v with key %#v\n", *certFile, *keyFile)
+	var hsFaults apns2mock.HandshakeFaults
+	if *handshakeFault != "" {
+		if hsFaults, err = apns2mock.ParseHandshakeFaults(*handshakeFault); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	var sched *apns2mock.Schedule
+	if *schedule != "" {
+		var err error
+		if sched, err = apns2mock.LoadSchedule(*schedule); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if *certFile == "" || *keyFile == "" {
+		commsCfg.TLS.CertHosts = splitList(*certHosts)
+		fmt.Fprintf(os.Stderr, "Using auto-generated certificate for %v\n", *certHosts)
+	} else {
+		fmt.Fprintf(os.Stderr, "Using certificate %#v with key %#v\n", *certFile, *keyFile)
+	}
 
 	srv, err := apns2mock.NewServer(commsCfg, handler, *certFile, *keyFile)
 	if err != nil {
@@ -139,7 +455,32 @@ func main() {
 	}
 	defer srv.Close()
 
+	if *rootCertOut != "" {
+		if err := ioutil.WriteFile(*rootCertOut, srv.RootCertificatePEM(), 0644); err != nil {
+			log.Fatal(err)
+		}
+		fmt.Fprintln(os.Stderr, "Wrote root certificate to ", *rootCertOut)
+	}
+
+	if err := srv.SetHandshakeFaults(hsFaults); err != nil {
+		log.Fatal(err)
+	}
+	srv.SetRecordLimit(*recordLimit)
+
 	fmt.Fprintln(os.Stderr, "Serving on ", *addr)
+	if *adminAddr != "" {
+		url, err := srv.ServeAdmin(*adminAddr)
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Fprintln(os.Stderr, "Serving admin API on ", url)
+	}
+	if sched != nil {
+		if err := srv.StartSchedule(*sched); err != nil {
+			log.Fatal(err)
+		}
+		fmt.Fprintln(os.Stderr, "Running schedule from ", *schedule)
+	}
 	fmt.Fprintln(os.Stderr, "Press Ctrl+C to stop...")
 
 	select {}
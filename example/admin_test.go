@@ -0,0 +1,238 @@
+// Copyright 2017 Aleksey Blinov. All rights reserved.
+
+package example
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/baobabus/go-apnsmock/apns2mock"
+)
+
+// adminDo sends admin API request with the specified JSON body
+// and decodes JSON response into v, if v is not nil.
+// It returns response status.
+func adminDo(t *testing.T, base string, method string, path string, body string, v interface{}) int {
+	req, _ := http.NewRequest(method, base+path, strings.NewReader(body))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if v != nil {
+		if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+			t.Errorf("%v %v: %v", method, path, err)
+		}
+	}
+	return resp.StatusCode
+}
+
+func TestAdminResponses(t *testing.T) {
+	s, err := apns2mock.NewServer(apns2mock.NoDelayCommsCfg, apns2mock.DefaultHandler, apns2mock.AutoCert, apns2mock.AutoKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	admin := httptest.NewServer(s.AdminHandler())
+	defer admin.Close()
+
+	if st := adminDo(t, admin.URL, "POST", "/unavailable", "", nil); st != 204 {
+		t.Errorf("got %v from /unavailable, expected 204", st)
+	}
+	if status, reason := post(t, s, "alert", "{}"); status != 503 || reason != "ServiceUnavailable" {
+		t.Errorf("got %v %#v while unavailable", status, reason)
+	}
+	if st := adminDo(t, admin.URL, "POST", "/available", "", nil); st != 204 {
+		t.Errorf("got %v from /available, expected 204", st)
+	}
+	if status, _ := post(t, s, "alert", "{}"); status != 200 {
+		t.Errorf("got %v after becoming available, expected 200", status)
+	}
+
+	if st := adminDo(t, admin.URL, "POST", "/responses", `{"token":"ABCD","status":410,"reason":"Unregistered"}`, nil); st != 204 {
+		t.Errorf("got %v from POST /responses, expected 204", st)
+	}
+	if st := adminDo(t, admin.URL, "POST", "/responses", `{"token":"abcd"}`, nil); st != 400 {
+		t.Errorf("got %v from POST /responses without status, expected 400", st)
+	}
+	for _, body := range []string{`{"status":42}`, `{"status":302}`, `{"status":1000}`} {
+		if st := adminDo(t, admin.URL, "POST", "/unavailable", body, nil); st != 400 {
+			t.Errorf("got %v from /unavailable with %v, expected 400", st, body)
+		}
+		if st := adminDo(t, admin.URL, "POST", "/responses", `{"token":"abcd",`+body[1:], nil); st != 400 {
+			t.Errorf("got %v from POST /responses with %v, expected 400", st, body)
+		}
+	}
+	var trs []struct {
+		Token  string
+		Status int
+	}
+	adminDo(t, admin.URL, "GET", "/responses", "", &trs)
+	if len(trs) != 1 || trs[0].Token != "abcd" || trs[0].Status != 410 {
+		t.Errorf("unexpected token responses %+v", trs)
+	}
+	if status, reason := post(t, s, "alert", "{}"); status != 410 || reason != "Unregistered" {
+		t.Errorf("got %v %#v for token with response", status, reason)
+	}
+	adminDo(t, admin.URL, "DELETE", "/responses?token=abcd", "", nil)
+	if len(s.TokenResponses()) != 0 {
+		t.Error("token response should have been removed")
+	}
+	if st := adminDo(t, admin.URL, "PUT", "/responses", "", nil); st != 405 {
+		t.Errorf("got %v from PUT /responses, expected 405", st)
+	}
+
+	var ns []struct {
+		DeviceToken string `json:"device_token"`
+		Status      int
+		Reason      string
+	}
+	adminDo(t, admin.URL, "GET", "/notifications?token=abcd", "", &ns)
+	if len(ns) != 3 || ns[0].Status != 503 || ns[2].Reason != "Unregistered" {
+		t.Errorf("unexpected notifications %+v", ns)
+	}
+	var stats apns2mock.Stats
+	adminDo(t, admin.URL, "GET", "/stats", "", &stats)
+	if stats.Received != 3 || stats.Statuses[200] != 1 || stats.Connections != 1 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+	if st := adminDo(t, admin.URL, "DELETE", "/notifications", "", nil); st != 204 || len(s.Received()) != 0 {
+		t.Errorf("got %v from DELETE /notifications and %v notifications left", st, len(s.Received()))
+	}
+}
+
+func TestAdminComms(t *testing.T) {
+	s, err := apns2mock.NewServer(apns2mock.NoDelayCommsCfg, apns2mock.AllOkayHandler, apns2mock.AutoCert, apns2mock.AutoKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	admin := httptest.NewServer(s.AdminHandler())
+	defer admin.Close()
+
+	var comms struct {
+		ConnectionDelay string `json:"connection_delay"`
+		ResponseTime    string `json:"response_time"`
+		Latency         string
+	}
+	if st := adminDo(t, admin.URL, "PUT", "/comms", `{"connection_delay":"5ms","response_time":"10ms"}`, &comms); st != 200 {
+		t.Errorf("got %v from PUT /comms, expected 200", st)
+	}
+	if comms.ConnectionDelay != "5ms" || comms.ResponseTime != "10ms" || comms.Latency != "" {
+		t.Errorf("unexpected comms %+v", comms)
+	}
+	if cfg := s.CommsCfg(); cfg.ConnectionDelay != 5*time.Millisecond || cfg.ResponseTime != 10*time.Millisecond {
+		t.Errorf("unexpected comms config %+v", cfg)
+	}
+	adminDo(t, admin.URL, "PUT", "/comms", `{"latency":"uniform:10ms,20ms"}`, &comms)
+	if cfg := s.CommsCfg(); cfg.Latency == nil || comms.Latency != cfg.Latency.String() || cfg.ConnectionDelay != 5*time.Millisecond {
+		t.Errorf("unexpected comms %+v", comms)
+	}
+	if st := adminDo(t, admin.URL, "PUT", "/comms", `{"response_time":"soon"}`, nil); st != 400 {
+		t.Errorf("got %v for invalid duration, expected 400", st)
+	}
+	if st := adminDo(t, admin.URL, "PUT", "/comms", `{`, nil); st != 400 {
+		t.Errorf("got %v for invalid JSON, expected 400", st)
+	}
+
+	if st := adminDo(t, admin.URL, "POST", "/faulty", `{"mode":"bogus"}`, nil); st != 400 {
+		t.Errorf("got %v for unknown fault mode, expected 400", st)
+	}
+	if st := adminDo(t, admin.URL, "POST", "/faulty", `{"mode":"reset-stream","code":11}`, nil); st != 204 {
+		t.Errorf("got %v from /faulty, expected 204", st)
+	}
+	if _, _, err := postFaulty(t, s, "abcd", time.Second); err == nil {
+		t.Error("expected request to fail with network fault")
+	}
+	adminDo(t, admin.URL, "POST", "/available", "", nil)
+}
+
+func TestAdminConnections(t *testing.T) {
+	s, err := apns2mock.NewServer(apns2mock.NoDelayCommsCfg, apns2mock.AllOkayHandler, apns2mock.AutoCert, apns2mock.AutoKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	url, err := s.ServeAdmin("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	post(t, s, "alert", "{}")
+	var conns []apns2mock.ConnInfo
+	if st := adminDo(t, url, "GET", "/connections", "", &conns); st != 200 {
+		t.Errorf("got %v from /connections, expected 200", st)
+	}
+	if len(conns) != 1 || conns[0].Streams != 1 || conns[0].ID != s.Received()[0].ConnID {
+		t.Errorf("unexpected connections %+v", conns)
+	}
+	var res struct{ Connections int }
+	adminDo(t, url, "POST", "/goaway", `{"code":0,"debug_data":"bye","connections":[12345]}`, &res)
+	if res.Connections != 0 {
+		t.Errorf("sent GOAWAY on %v unknown connections", res.Connections)
+	}
+	adminDo(t, url, "POST", "/goaway", `{"code":0,"debug_data":"bye"}`, &res)
+	if res.Connections != 1 {
+		t.Errorf("sent GOAWAY on %v connections, expected 1", res.Connections)
+	}
+
+	// Admin API is shut down along with the server.
+	s.Close()
+	if resp, err := http.Get(url + "/stats"); err == nil {
+		resp.Body.Close()
+		t.Error("admin API should be closed with the server")
+	}
+}
+
+func TestAdminHandshakeFaults(t *testing.T) {
+	s, err := apns2mock.NewServer(apns2mock.NoDelayCommsCfg, apns2mock.AllOkayHandler, apns2mock.AutoCert, apns2mock.AutoKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	admin := httptest.NewServer(s.AdminHandler())
+	defer admin.Close()
+
+	// failures returns which of n consecutive connection attempts fail.
+	failures := func(n int) []bool {
+		res := make([]bool, n)
+		for i := range res {
+			_, err := dialTLS(s, &tls.Config{})
+			res[i] = err != nil
+		}
+		return res
+	}
+	cases := []struct {
+		body     string
+		expected []bool
+	}{
+		{`{"fault":"alert/3"}`, []bool{false, false, true, false, false, true}},
+		{`{"fault":"alert/3","every":2}`, []bool{false, true, false, true}},
+		{`{"fault":"alert/50%","every":2}`, []bool{false, true, false, true}},
+		{`{"fault":"alert"}`, []bool{true, true}},
+		{`{"fault":"none"}`, []bool{false, false}},
+	}
+	for _, c := range cases {
+		if st := adminDo(t, admin.URL, "POST", "/handshake-faults", c.body, nil); st != 204 {
+			t.Errorf("%v: got %v, expected 204", c.body, st)
+			continue
+		}
+		if got := failures(len(c.expected)); !reflect.DeepEqual(got, c.expected) {
+			t.Errorf("%v: got failures %v, expected %v", c.body, got, c.expected)
+		}
+	}
+	for _, body := range []string{`{"fault":"bogus"}`, `{"fault":"alert/0"}`, `{"fault":"alert","percent":150}`} {
+		if st := adminDo(t, admin.URL, "POST", "/handshake-faults", body, nil); st != 400 {
+			t.Errorf("%v: got %v, expected 400", body, st)
+		}
+	}
+	if st := adminDo(t, admin.URL, "GET", "/handshake-faults", "", nil); st != 405 {
+		t.Errorf("got %v from GET /handshake-faults, expected 405", st)
+	}
+}
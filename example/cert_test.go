@@ -0,0 +1,172 @@
+// Copyright 2017 Aleksey Blinov. All rights reserved.
+
+package example
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/baobabus/go-apnsmock/apns2mock"
+	"golang.org/x/net/http2"
+)
+
+func makeCert(t *testing.T, cn string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey, isCA bool, exts []pkix.Extension) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: cn},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  isCA,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		ExtraExtensions:       exts,
+	}
+	if parent == nil {
+		parent, parentKey = tmpl, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
+
+// certClient returns a new client trusting the server and presenting
+// the specified client certificate. If cert is nil, client does not
+// present any certificate.
+func certClient(s *apns2mock.Server, cert *x509.Certificate, key *ecdsa.PrivateKey) *http.Client {
+	rCert, _ := x509.ParseCertificate(s.RootCertificate.Certificate[0])
+	roots := x509.NewCertPool()
+	roots.AddCert(rCert)
+	cfg := &tls.Config{RootCAs: roots}
+	if cert != nil {
+		cfg.Certificates = []tls.Certificate{
+			{Certificate: [][]byte{cert.Raw}, PrivateKey: key},
+		}
+	}
+	return &http.Client{
+		Transport: &http2.Transport{TLSClientConfig: cfg},
+	}
+}
+
+func TestCertAuth(t *testing.T) {
+	ca, caKey := makeCert(t, "Test CA", nil, nil, true, nil)
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+	handler := &apns2mock.CaseHandler{
+		CaseHandlers: apns2mock.JoinHandlers(
+			apns2mock.HeaderHandlers,
+			apns2mock.NewAuthHandlers(apns2mock.AuthTokenHandlers, apns2mock.NewCertHandlers(roots, apns2mock.Production)),
+		),
+	}
+	s, err := apns2mock.NewServer(apns2mock.NoDelayCommsCfg, handler, apns2mock.AutoCert, apns2mock.AutoKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	devExt := pkix.Extension{Id: asn1.ObjectIdentifier{1, 2, 840, 113635, 100, 6, 3, 1}, Value: []byte{5, 0}}
+	good, goodKey := makeCert(t, "Good", ca, caKey, false, nil)
+	rogue, rogueKey := makeCert(t, "Rogue", nil, nil, false, nil)
+	dev, devKey := makeCert(t, "Development", ca, caKey, false, []pkix.Extension{devExt})
+
+	cases := []struct {
+		name   string
+		client *http.Client
+		status int
+		reason string
+	}{
+		{"valid", certClient(s, good, goodKey), 200, ""},
+		{"untrusted", certClient(s, rogue, rogueKey), 403, "BadCertificate"},
+		{"wrong environment", certClient(s, dev, devKey), 403, "BadCertificateEnvironment"},
+		{"no certificate", s.Client(), 403, "MissingProviderToken"},
+	}
+	for _, c := range cases {
+		req, _ := http.NewRequest("POST", s.URL+apns2mock.RequestRoot+"abcd", strings.NewReader("{}"))
+		req.Header.Set("apns-topic", "com.example.app")
+		resp, err := c.client.Do(req)
+		if err != nil {
+			t.Fatalf("%v: %v", c.name, err)
+		}
+		var body struct{ Reason string }
+		json.NewDecoder(resp.Body).Decode(&body)
+		resp.Body.Close()
+		if resp.StatusCode != c.status || body.Reason != c.reason {
+			t.Errorf("%v: got %v %#v, expected %v %#v", c.name, resp.StatusCode, body.Reason, c.status, c.reason)
+		}
+	}
+
+	// Case handlers may supply client certificate without the chain.
+	req := &apns2mock.APNSRequest{ClientCert: good, Time: time.Now()}
+	if status, reason := apns2mock.NewCertHandlers(roots, apns2mock.AnyEnvironment)[0](req); status != 0 {
+		t.Errorf("got %v %#v for certificate without chain", status, reason)
+	}
+}
+
+func TestAutoCert(t *testing.T) {
+	s, err := apns2mock.NewServer(apns2mock.NoDelayCommsCfg, apns2mock.AllOkayHandler, apns2mock.AutoCert, apns2mock.AutoKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(s.RootCertificatePEM()) {
+		t.Fatal("root certificate PEM could not be parsed")
+	}
+	addr := strings.TrimPrefix(s.URL, "https://")
+	for _, host := range []string{"api.sandbox.push.apple.com", "api.push.apple.com", "localhost", "127.0.0.1"} {
+		conn, err := tls.Dial("tcp", addr, &tls.Config{RootCAs: roots, ServerName: host})
+		if err != nil {
+			t.Errorf("%v: %v", host, err)
+			continue
+		}
+		conn.Close()
+	}
+	if conn, err := tls.Dial("tcp", addr, &tls.Config{RootCAs: roots, ServerName: "api.push.example.com"}); err == nil {
+		conn.Close()
+		t.Error("expected host name verification to fail")
+	}
+	if status, _ := post(t, s, "alert", "{}"); status != 200 {
+		t.Errorf("got %v, expected 200 with pre-configured client", status)
+	}
+}
+
+func TestAutoCertHosts(t *testing.T) {
+	cfg := apns2mock.NoDelayCommsCfg
+	cfg.TLS.CertHosts = []string{"apns.example.com"}
+	s, err := apns2mock.NewServer(cfg, apns2mock.AllOkayHandler, apns2mock.AutoCert, apns2mock.AutoKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	for host, ok := range map[string]bool{"apns.example.com": true, "127.0.0.1": true, "api.push.apple.com": false} {
+		if _, err := dialTLS(s, &tls.Config{ServerName: host}); (err == nil) != ok {
+			t.Errorf("%v: got %v, expected success %v", host, err, ok)
+		}
+	}
+	if len(apns2mock.DefaultCertHosts) == 0 || apns2mock.DefaultCertHosts[0] != "localhost" {
+		t.Errorf("default hosts changed to %v", apns2mock.DefaultCertHosts)
+	}
+}
@@ -0,0 +1,161 @@
+// Copyright 2017 Aleksey Blinov. All rights reserved.
+
+package example
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/baobabus/go-apnsmock/apns2mock"
+)
+
+func TestDeviceRegistry(t *testing.T) {
+	unregAt := time.Date(2017, 6, 1, 12, 0, 0, 0, time.UTC)
+	reg := apns2mock.NewDeviceRegistry(
+		apns2mock.Device{Token: "aa01", Topic: "com.example.app", Environment: apns2mock.Production},
+		apns2mock.Device{Token: "aa02", Topic: "com.example.app", Environment: apns2mock.Sandbox},
+		apns2mock.Device{Token: "aa03", Topic: "com.example.app", State: apns2mock.DeviceUnregistered, UnregisteredAt: unregAt},
+	)
+	handler := &apns2mock.CaseHandler{
+		CaseHandlers: apns2mock.NewDeviceHandlers(reg, apns2mock.Production),
+	}
+	s, err := apns2mock.NewServer(apns2mock.NoDelayCommsCfg, handler, apns2mock.AutoCert, apns2mock.AutoKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	cases := []struct {
+		token     string
+		topic     string
+		status    int
+		reason    string
+		timestamp int64
+	}{
+		{"aa01", "com.example.app", 200, "", 0},
+		{"aa01", "com.example.app.voip", 200, "", 0},
+		{"aa01", "com.example.other", 400, "DeviceTokenNotForTopic", 0},
+		{"aa02", "com.example.app", 400, "BadDeviceToken", 0},
+		{"aa03", "com.example.app", 410, "Unregistered", unregAt.Unix() * 1000},
+		{"aa04", "com.example.app", 400, "BadDeviceToken", 0},
+	}
+	for _, c := range cases {
+		req, _ := http.NewRequest("POST", s.URL+apns2mock.RequestRoot+c.token, strings.NewReader("{}"))
+		req.Header.Set("apns-topic", c.topic)
+		req.Header.Set("authorization", "bearer "+signToken(t, "TEAM000001", "KEY0000001", testKey))
+		resp, err := s.Client().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var body struct {
+			Reason    string
+			Timestamp int64
+		}
+		json.NewDecoder(resp.Body).Decode(&body)
+		resp.Body.Close()
+		if resp.StatusCode != c.status || body.Reason != c.reason || body.Timestamp != c.timestamp {
+			t.Errorf("%v %v: got %v %#v %v, expected %v %#v %v", c.token, c.topic, resp.StatusCode, body.Reason, body.Timestamp, c.status, c.reason, c.timestamp)
+		}
+	}
+}
+
+// postToken sends a request for the specified device token
+// and returns response status and rejection reason.
+func postToken(t *testing.T, s *apns2mock.Server, token string) (int, string) {
+	req, _ := http.NewRequest("POST", s.URL+apns2mock.RequestRoot+token, strings.NewReader("{}"))
+	req.Header.Set("apns-topic", "com.example.app")
+	req.Header.Set("authorization", "bearer "+signToken(t, "TEAM000001", "KEY0000001", testKey))
+	resp, err := s.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var body struct{ Reason string }
+	json.NewDecoder(resp.Body).Decode(&body)
+	return resp.StatusCode, body.Reason
+}
+
+func TestRateLimit(t *testing.T) {
+	for _, l := range []apns2mock.RateLimit{{Window: time.Second}, {Max: 1}, {Window: -time.Second, Max: 1}} {
+		if _, err := apns2mock.NewRateLimitHandlers(l); err == nil {
+			t.Errorf("%+v: expected error", l)
+		}
+	}
+	hs, err := apns2mock.NewRateLimitHandlers(
+		apns2mock.RateLimit{Window: 300 * time.Millisecond, Max: 3},
+		apns2mock.RateLimit{Window: time.Hour, Max: 5},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := &apns2mock.CaseHandler{CaseHandlers: hs}
+	s, err := apns2mock.NewServer(apns2mock.NoDelayCommsCfg, handler, apns2mock.AutoCert, apns2mock.AutoKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	expect := func(token string, status int) {
+		if got, reason := postToken(t, s, token); got != status || (status == 429 && reason != "TooManyRequests") {
+			t.Errorf("%v: got %v %#v, expected %v", token, got, reason, status)
+		}
+	}
+	for i := 0; i < 3; i++ {
+		expect("aa01", 200)
+	}
+	expect("AA01", 429)
+	expect("aa02", 200)
+	time.Sleep(350 * time.Millisecond)
+	expect("aa01", 200)
+	expect("aa01", 200)
+	// The hourly limit is reached now.
+	expect("aa01", 429)
+}
+
+func TestEnvironmentPair(t *testing.T) {
+	reg := apns2mock.NewDeviceRegistry(
+		apns2mock.Device{Token: "aa01", Environment: apns2mock.Sandbox},
+		apns2mock.Device{Token: "bb01", Environment: apns2mock.Production},
+		apns2mock.Device{Token: "cc01"},
+	)
+	p, err := apns2mock.NewEnvironmentPair(apns2mock.NoDelayCommsCfg, reg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	if p.Sandbox.Environment() != apns2mock.Sandbox || p.Production.Environment() != apns2mock.Production {
+		t.Errorf("got %v and %v environments", p.Sandbox.Environment(), p.Production.Environment())
+	}
+	if p.Server(apns2mock.Production) != p.Production || p.Server(apns2mock.AnyEnvironment) != nil {
+		t.Error("unexpected server lookup")
+	}
+	cases := []struct {
+		env    apns2mock.Environment
+		token  string
+		status int
+	}{
+		{apns2mock.Sandbox, "aa01", 200},
+		{apns2mock.Production, "aa01", 400},
+		{apns2mock.Sandbox, "bb01", 400},
+		{apns2mock.Production, "bb01", 200},
+		{apns2mock.Sandbox, "cc01", 200},
+		{apns2mock.Production, "cc01", 200},
+		{apns2mock.Production, "dd01", 400},
+	}
+	for _, c := range cases {
+		status, reason := postToken(t, p.Server(c.env), c.token)
+		if status != c.status || (status == 400 && reason != "BadDeviceToken") {
+			t.Errorf("%v %v: got %v %#v, expected %v", c.env, c.token, status, reason, c.status)
+		}
+	}
+
+	// Tokens registered later are known to both servers.
+	reg.Add(apns2mock.Device{Token: "dd01", Environment: apns2mock.Production})
+	if status, reason := postToken(t, p.Production, "dd01"); status != 200 {
+		t.Errorf("got %v %#v, expected 200", status, reason)
+	}
+}
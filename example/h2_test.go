@@ -0,0 +1,220 @@
+// Copyright 2017 Aleksey Blinov. All rights reserved.
+
+package example
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/baobabus/go-apnsmock/apns2mock"
+	"golang.org/x/net/http2"
+)
+
+// dialH2 opens raw HTTP/2 connection to the server and waits
+// for server's SETTINGS frame. It returns the settings advertised
+// by the server.
+func dialH2(t *testing.T, s *apns2mock.Server) (*tls.Conn, *http2.Framer, map[http2.SettingID]uint32) {
+	rCert, _ := x509.ParseCertificate(s.RootCertificate.Certificate[0])
+	roots := x509.NewCertPool()
+	roots.AddCert(rCert)
+	conn, err := tls.Dial("tcp", strings.TrimPrefix(s.URL, "https://"), &tls.Config{
+		RootCAs:    roots,
+		NextProtos: []string{http2.NextProtoTLS},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Write([]byte(http2.ClientPreface)); err != nil {
+		t.Fatal(err)
+	}
+	fr := http2.NewFramer(conn, conn)
+	if err := fr.WriteSettings(); err != nil {
+		t.Fatal(err)
+	}
+	for {
+		f, err := fr.ReadFrame()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if sf, ok := f.(*http2.SettingsFrame); ok && !sf.IsAck() {
+			settings := map[http2.SettingID]uint32{}
+			sf.ForeachSetting(func(s http2.Setting) error {
+				settings[s.ID] = s.Val
+				return nil
+			})
+			return conn, fr, settings
+		}
+	}
+}
+
+// readUntil reads frames until it finds one for which f returns true.
+func readUntil(t *testing.T, fr *http2.Framer, f func(http2.Frame) bool) http2.Frame {
+	for {
+		res, err := fr.ReadFrame()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if f(res) {
+			return res
+		}
+	}
+}
+
+func TestSendGoAway(t *testing.T) {
+	s, err := apns2mock.NewServer(apns2mock.NoDelayCommsCfg, apns2mock.AllOkayHandler, apns2mock.AutoCert, apns2mock.AutoKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	conn, fr, _ := dialH2(t, s)
+	defer conn.Close()
+	if n := s.SendGoAway(http2.ErrCodeEnhanceYourCalm, []byte(`{"reason":"Shutdown"}`)); n != 1 {
+		t.Fatalf("sent GOAWAY on %v connections, expected 1", n)
+	}
+	f := readUntil(t, fr, func(f http2.Frame) bool {
+		_, ok := f.(*http2.GoAwayFrame)
+		return ok
+	})
+	ga := f.(*http2.GoAwayFrame)
+	if ga.ErrCode != http2.ErrCodeEnhanceYourCalm || string(ga.DebugData()) != `{"reason":"Shutdown"}` || ga.LastStreamID != 0 {
+		t.Errorf("unexpected GOAWAY %v %v %q", ga.LastStreamID, ga.ErrCode, ga.DebugData())
+	}
+	if n := s.SendGoAway(http2.ErrCodeNo, nil, 12345); n != 0 {
+		t.Errorf("sent GOAWAY on %v connections, expected 0", n)
+	}
+}
+
+func TestGoAwayAfterStreams(t *testing.T) {
+	cfg := apns2mock.NoDelayCommsCfg
+	cfg.GoAwayAfterStreams = 2
+	s, err := apns2mock.NewServer(cfg, apns2mock.AllOkayHandler, apns2mock.AutoCert, apns2mock.AutoKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	for i := 0; i < 4; i++ {
+		if status, _ := post(t, s, "alert", "{}"); status != 200 {
+			t.Fatalf("got %v, expected 200", status)
+		}
+		// Let the client process GOAWAY before sending the next request.
+		time.Sleep(50 * time.Millisecond)
+	}
+	ns := s.Received()
+	if ns[0].ConnID != ns[1].ConnID || ns[1].ConnID == ns[2].ConnID || ns[2].ConnID != ns[3].ConnID {
+		t.Errorf("unexpected connections %v %v %v %v", ns[0].ConnID, ns[1].ConnID, ns[2].ConnID, ns[3].ConnID)
+	}
+}
+
+func TestGoAwayAfterAge(t *testing.T) {
+	cfg := apns2mock.NoDelayCommsCfg
+	cfg.GoAwayAfterAge = 50 * time.Millisecond
+	s, err := apns2mock.NewServer(cfg, apns2mock.AllOkayHandler, apns2mock.AutoCert, apns2mock.AutoKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	conn, fr, _ := dialH2(t, s)
+	defer conn.Close()
+	f := readUntil(t, fr, func(f http2.Frame) bool {
+		_, ok := f.(*http2.GoAwayFrame)
+		return ok
+	})
+	if ga := f.(*http2.GoAwayFrame); ga.ErrCode != http2.ErrCodeNo {
+		t.Errorf("got GOAWAY with %v, expected graceful", ga.ErrCode)
+	}
+}
+
+func TestHTTP2Cfg(t *testing.T) {
+	cfg := apns2mock.NoDelayCommsCfg
+	cfg.HTTP2 = apns2mock.HTTP2Cfg{
+		InitialWindowSize: 1024,
+		MaxFrameSize:      32768,
+		MaxHeaderListSize: 4096,
+		Settings: []http2.Setting{
+			{ID: http2.SettingMaxConcurrentStreams, Val: 7},
+			{ID: 0xf000, Val: 42},
+		},
+	}
+	s, err := apns2mock.NewServer(cfg, apns2mock.AllOkayHandler, apns2mock.AutoCert, apns2mock.AutoKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	conn, _, settings := dialH2(t, s)
+	conn.Close()
+	expected := map[http2.SettingID]uint32{
+		http2.SettingInitialWindowSize:    1024,
+		http2.SettingMaxFrameSize:         32768,
+		http2.SettingMaxHeaderListSize:    4096,
+		http2.SettingMaxConcurrentStreams: 7,
+		0xf000:                            42,
+	}
+	for id, v := range expected {
+		if settings[id] != v {
+			t.Errorf("%v: got %v, expected %v", id, settings[id], v)
+		}
+	}
+	// Payload larger than the window is only received with flow control
+	// window updates sent by the server. The first request lets the client
+	// learn the window before it sends the payload.
+	if status, _ := post(t, s, "alert", "{}"); status != 200 {
+		t.Errorf("got %v, expected 200", status)
+	}
+	if status, _ := post(t, s, "alert", `{"aps":{"alert":"`+strings.Repeat("x", 3000)+`"}}`); status != 200 {
+		t.Errorf("got %v, expected 200", status)
+	}
+}
+
+func TestHTTP2IdleTimeout(t *testing.T) {
+	cfg := apns2mock.NoDelayCommsCfg
+	cfg.HTTP2.IdleTimeout = 100 * time.Millisecond
+	s, err := apns2mock.NewServer(cfg, apns2mock.AllOkayHandler, apns2mock.AutoCert, apns2mock.AutoKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	conn, fr, _ := dialH2(t, s)
+	defer conn.Close()
+	start := time.Now()
+	readUntil(t, fr, func(f http2.Frame) bool {
+		_, ok := f.(*http2.GoAwayFrame)
+		return ok
+	})
+	if d := time.Since(start); d > 2*time.Second {
+		t.Errorf("idle connection closed after %v", d)
+	}
+}
+
+func TestHTTP2CfgInvalid(t *testing.T) {
+	cases := []apns2mock.HTTP2Cfg{
+		{InitialWindowSize: 1 << 31},
+		{InitialConnWindowSize: 1024},
+		{InitialConnWindowSize: 1 << 31},
+		{MaxFrameSize: 1024},
+		{MaxFrameSize: 1 << 24},
+	}
+	for _, c := range cases {
+		cfg := apns2mock.NoDelayCommsCfg
+		cfg.HTTP2 = c
+		if s, err := apns2mock.NewServer(cfg, apns2mock.AllOkayHandler, apns2mock.AutoCert, apns2mock.AutoKey); err == nil {
+			s.Close()
+			t.Errorf("%+v: expected error", c)
+		}
+	}
+	cfg := apns2mock.NoDelayCommsCfg
+	cfg.HTTP2 = apns2mock.HTTP2Cfg{InitialWindowSize: 1<<31 - 1, InitialConnWindowSize: 65535, MaxFrameSize: 1<<24 - 1}
+	s, err := apns2mock.NewServer(cfg, apns2mock.AllOkayHandler, apns2mock.AutoCert, apns2mock.AutoKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+}
@@ -0,0 +1,126 @@
+// Copyright 2017 Aleksey Blinov. All rights reserved.
+
+package example
+
+import (
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/baobabus/go-apnsmock/apns2mock"
+)
+
+func TestParseLatency(t *testing.T) {
+	specs := []string{
+		"20ms",
+		"uniform:10ms,50ms",
+		"normal:20ms,5ms",
+		"lognormal:20ms,0.5",
+		"histogram:50=20ms,90=40ms,99=150ms",
+		"lognormal:20ms,0.5+spikes:1%,2s",
+	}
+	for _, spec := range specs {
+		l, err := apns2mock.ParseLatency(spec)
+		if err != nil {
+			t.Errorf("%v: %v", spec, err)
+			continue
+		}
+		if l.String() != spec {
+			t.Errorf("%v: got %v", spec, l)
+		}
+	}
+	if l, err := apns2mock.ParseLatency("histogram:p99=150ms,p50=20ms"); err != nil || l.String() != "histogram:50=20ms,99=150ms" {
+		t.Errorf("got %v %v", l, err)
+	}
+	for _, spec := range []string{"soon", "uniform:10ms", "gamma:1,2", "histogram:50=20ms,90=10ms", "histogram:150=1s", "20ms+spikes:1%"} {
+		if _, err := apns2mock.ParseLatency(spec); err == nil {
+			t.Errorf("%v: expected error", spec)
+		}
+	}
+}
+
+// sample returns n response times drawn from l in ascending order.
+func sample(l apns2mock.Latency, n int) []time.Duration {
+	res := make([]time.Duration, n)
+	for i := range res {
+		res[i] = l.Next()
+	}
+	sort.Sort(durations(res))
+	return res
+}
+
+type durations []time.Duration
+
+func (a durations) Len() int           { return len(a) }
+func (a durations) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a durations) Less(i, j int) bool { return a[i] < a[j] }
+
+func TestLatencyDistributions(t *testing.T) {
+	const n = 10000
+	within := func(name string, got, lo, hi time.Duration) {
+		if got < lo || got > hi {
+			t.Errorf("%v: got %v, expected between %v and %v", name, got, lo, hi)
+		}
+	}
+	s := sample(apns2mock.UniformLatency(10*time.Millisecond, 50*time.Millisecond), n)
+	within("uniform min", s[0], 10*time.Millisecond, 11*time.Millisecond)
+	within("uniform max", s[n-1], 49*time.Millisecond, 50*time.Millisecond)
+	s = sample(apns2mock.NormalLatency(20*time.Millisecond, 5*time.Millisecond), n)
+	within("normal median", s[n/2], 19*time.Millisecond, 21*time.Millisecond)
+	within("normal p84", s[n*84/100], 24*time.Millisecond, 26*time.Millisecond)
+	s = sample(apns2mock.LogNormalLatency(20*time.Millisecond, 0.5), n)
+	within("lognormal median", s[n/2], 19*time.Millisecond, 21*time.Millisecond)
+	hl, err := apns2mock.HistogramLatency(
+		apns2mock.Percentile{P: 50, D: 20 * time.Millisecond},
+		apns2mock.Percentile{P: 90, D: 40 * time.Millisecond},
+		apns2mock.Percentile{P: 99, D: 150 * time.Millisecond},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s = sample(hl, n)
+	within("histogram p50", s[n/2], 20*time.Millisecond, 22*time.Millisecond)
+	within("histogram p80", s[n*80/100], 34*time.Millisecond, 36*time.Millisecond)
+	within("histogram max", s[n-1], 150*time.Millisecond, 150*time.Millisecond)
+	s = sample(apns2mock.WithSpikes(apns2mock.FixedLatency(time.Millisecond), 5, time.Second), n)
+	within("spikes p94", s[n*94/100], time.Millisecond, time.Millisecond)
+	within("spikes p96", s[n*96/100], time.Second, time.Second)
+}
+
+func TestLatencyOverride(t *testing.T) {
+	handler := &apns2mock.CaseHandler{
+		CaseHandlers: []apns2mock.HadlerFunc{
+			func(req *apns2mock.APNSRequest) (int, string) {
+				if req.DeviceToken == "aa01" {
+					req.Latency = apns2mock.FixedLatency(0)
+				}
+				return 0, ""
+			},
+		},
+	}
+	cfg := apns2mock.NoDelayCommsCfg
+	cfg.Latency = apns2mock.UniformLatency(200*time.Millisecond, 300*time.Millisecond)
+	s, err := apns2mock.NewServer(cfg, handler, apns2mock.AutoCert, apns2mock.AutoKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	took := func(token string) time.Duration {
+		start := time.Now()
+		if status, reason := postToken(t, s, token); status != 200 {
+			t.Fatalf("%v: got %v %#v, expected 200", token, status, reason)
+		}
+		return time.Since(start)
+	}
+	if d := took("aa02"); d < 200*time.Millisecond {
+		t.Errorf("took %v, expected at least 200ms", d)
+	}
+	if d := took("aa01"); d >= 200*time.Millisecond {
+		t.Errorf("took %v, expected override to take less than 200ms", d)
+	}
+	s.SetResponseTime(0)
+	if d := took("aa02"); d >= 200*time.Millisecond {
+		t.Errorf("took %v, expected SetResponseTime to remove latency", d)
+	}
+}
@@ -0,0 +1,181 @@
+// Copyright 2017 Aleksey Blinov. All rights reserved.
+
+package example
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/baobabus/go-apnsmock/apns2mock"
+	"golang.org/x/net/http2"
+)
+
+// postFaulty sends a request for the specified device token and returns
+// response status, response body and the first error encountered.
+func postFaulty(t *testing.T, s *apns2mock.Server, token string, timeout time.Duration) (int, string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	req, _ := http.NewRequest("POST", s.URL+apns2mock.RequestRoot+token, strings.NewReader("{}"))
+	req.Header.Set("apns-topic", "com.example.app")
+	req.Header.Set("authorization", "bearer "+signToken(t, "TEAM000001", "KEY0000001", testKey))
+	resp, err := s.Client().Do(req.WithContext(ctx))
+	if err != nil {
+		return 0, "", err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	return resp.StatusCode, string(body), err
+}
+
+func TestNetFault(t *testing.T) {
+	faults := map[string]apns2mock.NetFault{
+		"aa01": {Mode: apns2mock.ResetStream, ErrCode: http2.ErrCodeEnhanceYourCalm},
+		"aa02": {Mode: apns2mock.ResetConnection},
+		"aa03": {Mode: apns2mock.HalfWrite},
+		"aa04": {Mode: apns2mock.Hang},
+	}
+	handler := &apns2mock.CaseHandler{
+		CaseHandlers: []apns2mock.HadlerFunc{
+			func(req *apns2mock.APNSRequest) (int, string) {
+				if f, ok := faults[req.DeviceToken]; ok {
+					req.NetFault = f
+					return 500, "InternalServerError"
+				}
+				return 0, ""
+			},
+		},
+	}
+	s, err := apns2mock.NewServer(apns2mock.NoDelayCommsCfg, handler, apns2mock.AutoCert, apns2mock.AutoKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	if _, _, err := postFaulty(t, s, "aa01", time.Second); err == nil || !strings.Contains(err.Error(), "ENHANCE_YOUR_CALM") {
+		t.Errorf("reset stream: got %v, expected ENHANCE_YOUR_CALM stream error", err)
+	}
+	if _, _, err := postFaulty(t, s, "aa02", time.Second); err == nil {
+		t.Error("reset connection: expected error")
+	}
+	status, body, err := postFaulty(t, s, "aa03", time.Second)
+	if status != 500 || err == nil || body != `{"reason": "Inte` {
+		t.Errorf("half write: got %v %#v %v, expected 500 with partial body and error", status, body, err)
+	}
+	start := time.Now()
+	if _, _, err := postFaulty(t, s, "aa04", 200*time.Millisecond); err == nil || time.Since(start) < 200*time.Millisecond {
+		t.Errorf("hang: got %v after %v, expected timeout", err, time.Since(start))
+	}
+	if status, _, err := postFaulty(t, s, "aa05", time.Second); status != 200 || err != nil {
+		t.Errorf("got %v %v, expected 200", status, err)
+	}
+
+	ns, err := s.WaitForCount(5, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	modes := map[string]apns2mock.NetFaultMode{}
+	for _, n := range ns {
+		modes[n.DeviceToken] = n.NetFault
+	}
+	for token, f := range faults {
+		if modes[token] != f.Mode {
+			t.Errorf("%v: recorded %v, expected %v", token, modes[token], f.Mode)
+		}
+	}
+	if modes["aa05"] != apns2mock.NoNetFault {
+		t.Errorf("aa05: recorded %v, expected none", modes["aa05"])
+	}
+}
+
+func TestBecomeFaulty(t *testing.T) {
+	s, err := apns2mock.NewServer(apns2mock.NoDelayCommsCfg, apns2mock.AllOkayHandler, apns2mock.AutoCert, apns2mock.AutoKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	s.BecomeFaulty(apns2mock.NetFault{Mode: apns2mock.ResetStream})
+	if _, _, err := postFaulty(t, s, "aa01", time.Second); err == nil || !strings.Contains(err.Error(), "INTERNAL_ERROR") {
+		t.Errorf("got %v, expected INTERNAL_ERROR stream error", err)
+	}
+	s.BecomeAvailable()
+	if status, _, err := postFaulty(t, s, "aa01", time.Second); status != 200 || err != nil {
+		t.Errorf("got %v %v, expected 200", status, err)
+	}
+}
+
+func TestNetFaultConcurrentResets(t *testing.T) {
+	handler := &apns2mock.CaseHandler{
+		CaseHandlers: []apns2mock.HadlerFunc{
+			func(req *apns2mock.APNSRequest) (int, string) {
+				req.NetFault = apns2mock.NetFault{Mode: apns2mock.ResetStream}
+				if req.DeviceToken == "aa01" {
+					req.NetFault.ErrCode = http2.ErrCodeEnhanceYourCalm
+				}
+				return 500, "InternalServerError"
+			},
+		},
+	}
+	s, err := apns2mock.NewServer(apns2mock.NoDelayCommsCfg, handler, apns2mock.AutoCert, apns2mock.AutoKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	// Streams reset with default error code must not pick up
+	// codes meant for other streams of the same connection.
+	expected := map[string]string{"aa01": "ENHANCE_YOUR_CALM", "aa02": "INTERNAL_ERROR"}
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		token := "aa01"
+		if i%2 == 1 {
+			token = "aa02"
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, _, err := postFaulty(t, s, token, time.Second); err == nil || !strings.Contains(err.Error(), expected[token]) {
+				t.Errorf("%v: got %v, expected %v stream error", token, err, expected[token])
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// TestResetStreamErrCodes checks that every stream error code can be
+// sent. Codes other than INTERNAL_ERROR rely on finding stream IDs
+// in unexported state of golang.org/x/net/http2 response writers,
+// so this test fails if an x/net upgrade changes its layout.
+func TestResetStreamErrCodes(t *testing.T) {
+	handler := &apns2mock.CaseHandler{
+		CaseHandlers: []apns2mock.HadlerFunc{
+			func(req *apns2mock.APNSRequest) (int, string) {
+				code, _ := strconv.ParseUint(req.DeviceToken, 16, 32)
+				req.NetFault = apns2mock.NetFault{Mode: apns2mock.ResetStream, ErrCode: http2.ErrCode(code)}
+				return 500, "InternalServerError"
+			},
+		},
+	}
+	s, err := apns2mock.NewServer(apns2mock.NoDelayCommsCfg, handler, apns2mock.AutoCert, apns2mock.AutoKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	for code := http2.ErrCodeProtocol; code <= http2.ErrCodeHTTP11Required; code++ {
+		if code == http2.ErrCodeProtocol || code == http2.ErrCodeRefusedStream {
+			// Go HTTP/2 client retries requests reset with these codes.
+			continue
+		}
+		if _, _, err := postFaulty(t, s, fmt.Sprintf("%04x", uint32(code)), time.Second); err == nil || !strings.Contains(err.Error(), code.String()) {
+			t.Errorf("got %v, expected %v stream error", err, code)
+		}
+	}
+}
@@ -0,0 +1,152 @@
+// Copyright 2017 Aleksey Blinov. All rights reserved.
+
+package example
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/baobabus/go-apnsmock/apns2mock"
+)
+
+// post sends a request with the specified push type and payload
+// and returns response status and rejection reason.
+func post(t *testing.T, s *apns2mock.Server, pushType string, payload string) (int, string) {
+	return postHeader(t, s, http.Header{"Apns-Push-Type": {pushType}}, payload)
+}
+
+// postHeader sends a request with the specified headers and payload
+// and returns response status and rejection reason. Default topic
+// matching the push type is used unless apns-topic header is supplied.
+func postHeader(t *testing.T, s *apns2mock.Server, header http.Header, payload string) (int, string) {
+	req, _ := http.NewRequest("POST", s.URL+apns2mock.RequestRoot+"abcd", strings.NewReader(payload))
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	pushType := req.Header.Get("apns-push-type")
+	if req.Header.Get("apns-topic") == "" {
+		req.Header.Set("apns-topic", "com.example.app"+apns2mock.PushTypes[pushType])
+	}
+	req.Header.Set("authorization", "bearer "+signToken(t, "TEAM000001", "KEY0000001", testKey))
+	if pushType == "" {
+		req.Header.Del("apns-push-type")
+	}
+	resp, err := s.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var body struct{ Reason string }
+	json.NewDecoder(resp.Body).Decode(&body)
+	return resp.StatusCode, body.Reason
+}
+
+func TestPayload(t *testing.T) {
+	badgeHandler := func(req *apns2mock.APNSRequest) (int, string) {
+		aps, _ := req.Payload["aps"].(map[string]interface{})
+		if badge, _ := aps["badge"].(float64); badge != 3 {
+			return 400, "WrongBadge"
+		}
+		return 0, ""
+	}
+	handler := &apns2mock.CaseHandler{
+		CaseHandlers: []apns2mock.HadlerFunc{badgeHandler},
+	}
+	s, err := apns2mock.NewServer(apns2mock.NoDelayCommsCfg, handler, apns2mock.AutoCert, apns2mock.AutoKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	cases := []struct {
+		payload string
+		status  int
+		reason  string
+	}{
+		{`{"aps":{"alert":"Hi","badge":3}}`, 200, ""},
+		{`{"aps":{"alert":"Hi","badge":4}}`, 400, "WrongBadge"},
+		{`{"aps":`, 400, "BadPayload"},
+		{`["aps"]`, 400, "BadPayload"},
+		{`null`, 400, "BadPayload"},
+	}
+	for _, c := range cases {
+		if status, reason := post(t, s, "", c.payload); status != c.status || reason != c.reason {
+			t.Errorf("%v: got %v %#v, expected %v %#v", c.payload, status, reason, c.status, c.reason)
+		}
+	}
+}
+
+func TestPayloadTooLarge(t *testing.T) {
+	handler := &apns2mock.CaseHandler{
+		CaseHandlers:  apns2mock.DefaultHandler.CaseHandlers,
+		PayloadLimits: map[string]int{"mdm": 100},
+	}
+	s, err := apns2mock.NewServer(apns2mock.NoDelayCommsCfg, handler, apns2mock.AutoCert, apns2mock.AutoKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	payload := func(size int) string {
+		return `{"pad":"` + strings.Repeat("x", size-10) + `"}`
+	}
+	cases := []struct {
+		pushType string
+		size     int
+		status   int
+	}{
+		{"alert", 4096, 200},
+		{"alert", 4097, 413},
+		{"voip", 5120, 200},
+		{"voip", 5121, 413},
+		{"mdm", 100, 200},
+		{"mdm", 101, 413},
+	}
+	for _, c := range cases {
+		status, reason := post(t, s, c.pushType, payload(c.size))
+		if status != c.status {
+			t.Errorf("%v %v: got status %v, expected %v", c.pushType, c.size, status, c.status)
+		}
+		if status == 413 && reason != "PayloadTooLarge" {
+			t.Errorf("%v %v: got reason %#v, expected \"PayloadTooLarge\"", c.pushType, c.size, reason)
+		}
+	}
+
+	// Oversized payloads are recorded only up to one byte past the limit.
+	s.Reset()
+	if status, _ := post(t, s, "mdm", payload(1<<20)); status != 413 {
+		t.Errorf("got status %v, expected 413", status)
+	}
+	if ns := s.Received(); len(ns) != 1 || len(ns[0].RawPayload) != 101 {
+		t.Errorf("unexpected recorded notifications %v", len(ns))
+	}
+}
+
+func TestPushType(t *testing.T) {
+	s, err := apns2mock.NewServer(apns2mock.NoDelayCommsCfg, apns2mock.DefaultHandler, apns2mock.AutoCert, apns2mock.AutoKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	cases := []struct {
+		header http.Header
+		status int
+		reason string
+	}{
+		{http.Header{"Apns-Push-Type": {"alert"}}, 200, ""},
+		{http.Header{"Apns-Push-Type": {"bogus"}}, 400, "InvalidPushType"},
+		{http.Header{"Apns-Push-Type": {"background"}, "Apns-Priority": {"5"}}, 200, ""},
+		{http.Header{"Apns-Push-Type": {"background"}, "Apns-Priority": {"10"}}, 400, "BadPriority"},
+		{http.Header{"Apns-Push-Type": {"voip"}, "Apns-Topic": {"com.example.app.voip"}}, 200, ""},
+		{http.Header{"Apns-Push-Type": {"voip"}, "Apns-Topic": {"com.example.app"}}, 400, "TopicDisallowed"},
+		{http.Header{"Apns-Push-Type": {"liveactivity"}, "Apns-Topic": {"com.example.app.complication"}}, 400, "TopicDisallowed"},
+	}
+	for _, c := range cases {
+		if status, reason := postHeader(t, s, c.header, "{}"); status != c.status || reason != c.reason {
+			t.Errorf("%v: got %v %#v, expected %v %#v", c.header, status, reason, c.status, c.reason)
+		}
+	}
+}
@@ -0,0 +1,96 @@
+// Copyright 2017 Aleksey Blinov. All rights reserved.
+
+package example
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/baobabus/go-apnsmock/apns2mock"
+)
+
+const testScenario = `
+rules:
+  - name: voip is fine
+    device_token_prefix: AB
+    push_type: voip
+    status: 200
+  - priority: "5"
+    status: 400
+    reason: LowPriority
+  - team: TEAM000001
+    payload:
+      aps.alert.title: Boom
+      aps.alert.loc-args.1: 2
+    status: 500
+    reason: InternalServerError
+  - payload:
+      custom_id: 1000000
+    status: 410
+    reason: Unregistered
+  - device_token_regex: "^a[0-9a-f]+$"
+    topic: com.example.other
+    status: 400
+    reason: DeviceTokenNotForTopic
+`
+
+func TestScenario(t *testing.T) {
+	sc, err := apns2mock.ParseScenario([]byte(testScenario))
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler, err := sc.CaseHandler(apns2mock.PushTypeHandlers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := apns2mock.NewServer(apns2mock.NoDelayCommsCfg, handler, apns2mock.AutoCert, apns2mock.AutoKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	cases := []struct {
+		header  http.Header
+		payload string
+		status  int
+		reason  string
+	}{
+		{http.Header{}, `{}`, 200, ""},
+		{http.Header{"Apns-Push-Type": {"voip"}, "Apns-Topic": {"com.example.app"}}, `{}`, 200, ""},
+		{http.Header{"Apns-Push-Type": {"complication"}, "Apns-Topic": {"com.example.app"}}, `{}`, 400, "TopicDisallowed"},
+		{http.Header{"Apns-Priority": {"5"}}, `{}`, 400, "LowPriority"},
+		{http.Header{}, `{"aps":{"alert":{"title":"Boom","loc-args":[1,2]}}}`, 500, "InternalServerError"},
+		{http.Header{}, `{"aps":{"alert":{"title":"Boom","loc-args":[1,3]}}}`, 200, ""},
+		{http.Header{}, `{"aps":{"alert":{"title":"Boom"}}}`, 200, ""},
+		{http.Header{}, `{"custom_id":1000000}`, 410, "Unregistered"},
+		{http.Header{}, `{"custom_id":1000001}`, 200, ""},
+		{http.Header{"Apns-Topic": {"com.example.other"}}, `{}`, 400, "DeviceTokenNotForTopic"},
+	}
+	for i, c := range cases {
+		if status, reason := postHeader(t, s, c.header, c.payload); status != c.status || reason != c.reason {
+			t.Errorf("case %v: got %v %#v, expected %v %#v", i, status, reason, c.status, c.reason)
+		}
+	}
+}
+
+func TestScenarioParse(t *testing.T) {
+	sc, err := apns2mock.ParseScenario([]byte(`{"rules": [{"device_token": "abcd", "delay": "1ms", "status": 410, "reason": "Unregistered"}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sc.Rules) != 1 || sc.Rules[0].DeviceToken != "abcd" || sc.Rules[0].Status != 410 {
+		t.Errorf("unexpected scenario %+v", sc)
+	}
+	for _, bad := range []string{
+		"rules:\n  - device_token_regex: \"[\"\n",
+		"rules:\n  - delay: soon\n",
+		"rules:\n  - status: 1000\n",
+		"rules:\n  - status: 42\n",
+		"rules:\n  - status: 302\n",
+		"rules: [",
+	} {
+		if _, err := apns2mock.ParseScenario([]byte(bad)); err == nil {
+			t.Errorf("expected error parsing %#v", bad)
+		}
+	}
+}
@@ -0,0 +1,419 @@
+// Copyright 2017 Aleksey Blinov. All rights reserved.
+
+package example
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/baobabus/go-apnsmock/apns2mock"
+)
+
+func TestReceived(t *testing.T) {
+	s, err := apns2mock.NewServer(apns2mock.NoDelayCommsCfg, apns2mock.DefaultHandler, apns2mock.AutoCert, apns2mock.AutoKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	post(t, s, "alert", `{"aps":{"alert":"Hi"}}`)
+	postHeader(t, s, http.Header{"Apns-Push-Type": {"bogus"}}, `{}`)
+
+	ns := s.Received()
+	if len(ns) != 2 {
+		t.Fatalf("got %v notifications, expected 2", len(ns))
+	}
+	n := ns[0]
+	if n.DeviceToken != "abcd" || n.Status != 200 || n.Reason != "" || n.ID == "" || n.ConnID == 0 {
+		t.Errorf("unexpected notification %+v", n)
+	}
+	if n.TokenClaims["iss"] != "TEAM000001" {
+		t.Errorf("got claims %v", n.TokenClaims)
+	}
+	if aps, _ := n.Payload["aps"].(map[string]interface{}); aps["alert"] != "Hi" || string(n.RawPayload) != `{"aps":{"alert":"Hi"}}` {
+		t.Errorf("got payload %v", n.Payload)
+	}
+	if n := ns[1]; n.Status != 400 || n.Reason != "InvalidPushType" || n.ConnID != ns[0].ConnID {
+		t.Errorf("unexpected notification %+v", n)
+	}
+	if ns := s.ReceivedFor("ABCD"); len(ns) != 2 {
+		t.Errorf("got %v notifications for token, expected 2", len(ns))
+	}
+	if ns := s.ReceivedFor("ef01"); len(ns) != 0 {
+		t.Errorf("got %v notifications for other token, expected 0", len(ns))
+	}
+	s.Reset()
+	if ns := s.Received(); len(ns) != 0 {
+		t.Errorf("got %v notifications after reset, expected 0", len(ns))
+	}
+
+	s.SetRecordLimit(2)
+	for _, tok := range []string{"aa01", "aa02", "aa03"} {
+		postToken(t, s, tok)
+	}
+	if ns := s.Received(); len(ns) != 2 || ns[0].DeviceToken != "aa02" || ns[1].DeviceToken != "aa03" {
+		t.Errorf("unexpected notifications %v after limiting", len(ns))
+	}
+	start := time.Now()
+	if _, err := s.WaitForCount(3, 5*time.Second); err == nil || time.Since(start) > time.Second {
+		t.Errorf("got %v after %v waiting for more notifications than kept, expected immediate error", err, time.Since(start))
+	}
+	s.SetRecordLimit(-1)
+	postToken(t, s, "aa04")
+	if ns := s.Received(); len(ns) != 0 {
+		t.Errorf("got %v notifications with recording disabled, expected 0", len(ns))
+	}
+	start = time.Now()
+	if _, err := s.WaitFor(func(n apns2mock.Notification) bool { return true }, 5*time.Second); err == nil || time.Since(start) > time.Second {
+		t.Errorf("got %v after %v waiting with recording disabled, expected immediate error", err, time.Since(start))
+	}
+	if st := s.Stats(); st.Received != 4 {
+		t.Errorf("got %v received in stats, expected 4", st.Received)
+	}
+}
+
+func TestWaitFor(t *testing.T) {
+	s, err := apns2mock.NewServer(apns2mock.NoDelayCommsCfg, apns2mock.AllOkayHandler, apns2mock.AutoCert, apns2mock.AutoKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	go func() {
+		for _, token := range []string{"aa01", "aa02", "aa03"} {
+			time.Sleep(10 * time.Millisecond)
+			resp, err := s.Client().Post(s.URL+apns2mock.RequestRoot+token, "application/json", strings.NewReader("{}"))
+			if err == nil {
+				resp.Body.Close()
+			}
+		}
+	}()
+
+	ns, err := s.WaitFor(func(n apns2mock.Notification) bool { return n.DeviceToken == "aa02" }, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ns) != 1 || ns[0].DeviceToken != "aa02" {
+		t.Errorf("got %+v, expected single notification for aa02", ns)
+	}
+	if ns, err = s.WaitForCount(3, 5*time.Second); err != nil || len(ns) != 3 {
+		t.Errorf("got %v notifications and error %v, expected 3", len(ns), err)
+	}
+	if ns, err = s.WaitForCount(4, 50*time.Millisecond); err == nil || len(ns) != 3 {
+		t.Errorf("got %v notifications and error %v, expected 3 and timeout", len(ns), err)
+	}
+	_, err = s.WaitFor(func(n apns2mock.Notification) bool { return n.DeviceToken == "ff" }, 50*time.Millisecond)
+	if err == nil || !strings.HasSuffix(err.Error(), "received 3 other") {
+		t.Errorf("got error %v, expected timeout with 3 other notifications", err)
+	}
+}
+
+// errorRecorder is apns2mock.TestingT that collects reported errors.
+type errorRecorder []string
+
+func (r *errorRecorder) Errorf(format string, args ...interface{}) {
+	*r = append(*r, fmt.Sprintf(format, args...))
+}
+
+func TestExpect(t *testing.T) {
+	s, err := apns2mock.NewServer(apns2mock.NoDelayCommsCfg, apns2mock.DefaultHandler, apns2mock.AutoCert, apns2mock.AutoKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	s.Expect().DeviceToken("abcd").PushType("voip").Times(2).Respond(410, "Unregistered")
+	s.Expect().DeviceToken("abcd").PushType("alert")
+
+	for i := 0; i < 2; i++ {
+		if status, reason := post(t, s, "voip", "{}"); status != 410 || reason != "Unregistered" {
+			t.Errorf("got %v %#v, expected 410 \"Unregistered\"", status, reason)
+		}
+	}
+	if status, _ := post(t, s, "alert", "{}"); status != 200 {
+		t.Errorf("got %v, expected 200 from handler", status)
+	}
+	if !s.Verify(t) {
+		t.Error("expectations should have been met")
+	}
+
+	// Exhausted expectations no longer match.
+	if status, _ := post(t, s, "voip", "{}"); status != 200 {
+		t.Errorf("got %v, expected 200 from handler", status)
+	}
+	s.Expect().Topic("com.example.other")
+	var errs errorRecorder
+	if s.Verify(&errs) || len(errs) != 2 {
+		t.Errorf("expected unmet expectation and unexpected request, got %v", errs)
+	}
+	s.ClearExpectations()
+	post(t, s, "alert", "{}")
+	if !s.Verify(t) {
+		t.Error("requests received without expectations should verify")
+	}
+
+	// Token responses take precedence and do not use up expectations.
+	s.SetTokenResponse("abcd", 410, "Unregistered")
+	s.Expect().DeviceToken("abcd")
+	if status, _ := post(t, s, "alert", "{}"); status != 410 {
+		t.Errorf("got %v, expected 410 token response", status)
+	}
+	errs = nil
+	if s.Verify(&errs) || len(errs) != 1 {
+		t.Errorf("expected unmet expectation, got %v", errs)
+	}
+	s.ClearTokenResponse("abcd")
+	post(t, s, "alert", "{}")
+	if !s.Verify(t) {
+		t.Error("expectation should have been met")
+	}
+}
+
+func TestFaultProfile(t *testing.T) {
+	profile := apns2mock.FaultProfile{
+		Seed: 42,
+		Faults: []apns2mock.Fault{
+			{Percent: 20, Status: 500, Reason: "InternalServerError"},
+			{Percent: 10, Status: 503, Reason: "ServiceUnavailable"},
+		},
+	}
+	run := func() []int {
+		s, err := apns2mock.NewServer(apns2mock.NoDelayCommsCfg, apns2mock.AllOkayHandler, apns2mock.AutoCert, apns2mock.AutoKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer s.Close()
+		if err := s.SetFaultProfile(profile); err != nil {
+			t.Fatal(err)
+		}
+		res := []int{}
+		for i := 0; i < 100; i++ {
+			status, _ := post(t, s, "alert", "{}")
+			res = append(res, status)
+		}
+		return res
+	}
+	first, second := run(), run()
+	counts := map[int]int{}
+	for i, status := range first {
+		counts[status]++
+		if second[i] != status {
+			t.Fatalf("request %v: got %v, expected %v from the same seed", i, second[i], status)
+		}
+	}
+	if counts[500] == 0 || counts[503] == 0 || counts[200] < 50 || len(counts) != 3 {
+		t.Errorf("unexpected status distribution %v", counts)
+	}
+	s, err := apns2mock.NewServer(apns2mock.NoDelayCommsCfg, apns2mock.AllOkayHandler, apns2mock.AutoCert, apns2mock.AutoKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if err := s.SetFaultProfile(apns2mock.FaultProfile{Faults: []apns2mock.Fault{{Percent: 60, Status: 500}, {Percent: 50, Status: 503}}}); err == nil {
+		t.Error("expected error for percentages over 100")
+	}
+	if err := s.SetFaultProfile(apns2mock.FaultProfile{Faults: []apns2mock.Fault{{Percent: 60}}}); err == nil {
+		t.Error("expected error for missing status")
+	}
+	if err := s.SetFaultProfile(apns2mock.FaultProfile{Faults: []apns2mock.Fault{{Percent: 10, Status: 200}}}); err == nil {
+		t.Error("expected error for successful status")
+	}
+}
+
+func TestSchedule(t *testing.T) {
+	s, err := apns2mock.NewServer(apns2mock.NoDelayCommsCfg, apns2mock.AllOkayHandler, apns2mock.AutoCert, apns2mock.AutoKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	// waitStatus polls the server until it responds with status
+	// and fails the test if it does not do so within timeout.
+	waitStatus := func(status int, timeout time.Duration) {
+		deadline := time.Now().Add(timeout)
+		for {
+			got, _ := post(t, s, "alert", "{}")
+			if got == status {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("got %v, expected %v", got, status)
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+
+	sc, err := apns2mock.ParseSchedule([]byte("phases:\n  - duration: 50ms\n    status: 503\n    reason: ServiceUnavailable\n  - status: 500\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.StartSchedule(*sc); err != nil {
+		t.Fatal(err)
+	}
+	waitStatus(503, time.Second)
+	waitStatus(500, 2*time.Second)
+	s.StopSchedule()
+	waitStatus(200, 0)
+
+	err = s.StartSchedule(apns2mock.Schedule{
+		Phases: []apns2mock.Phase{{Duration: 30 * time.Millisecond, Status: 503}, {Duration: 30 * time.Millisecond}},
+		Loop:   true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		waitStatus(503, 2*time.Second)
+		waitStatus(200, 2*time.Second)
+	}
+	s.StopSchedule()
+
+	if err := s.StartSchedule(apns2mock.Schedule{Phases: []apns2mock.Phase{{Duration: 30 * time.Millisecond, Status: 429}}}); err != nil {
+		t.Fatal(err)
+	}
+	waitStatus(429, time.Second)
+	// Server becomes available once non-looping schedule is over.
+	waitStatus(200, 2*time.Second)
+
+	// Schedule does not affect server's own availability.
+	s.BecomeUnavailable(500, "InternalServerError")
+	err = s.StartSchedule(apns2mock.Schedule{
+		Phases: []apns2mock.Phase{{Duration: 30 * time.Millisecond}, {Duration: 30 * time.Millisecond, Status: 503}},
+		Loop:   true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitStatus(503, 2*time.Second)
+	waitStatus(500, 2*time.Second)
+	s.StopSchedule()
+	waitStatus(500, 0)
+	s.BecomeAvailable()
+
+	if err := s.StartSchedule(apns2mock.Schedule{Loop: true}); err == nil {
+		t.Error("expected error for schedule without phases")
+	}
+	if err := s.StartSchedule(apns2mock.Schedule{Phases: []apns2mock.Phase{{Status: 42}}}); err == nil {
+		t.Error("expected error for invalid status")
+	}
+	if _, err := apns2mock.ParseSchedule([]byte(`{"phases": [{"duration": "soon"}]}`)); err == nil {
+		t.Error("expected error for invalid duration")
+	}
+}
+
+func TestFakeClock(t *testing.T) {
+	s, err := apns2mock.NewServer(apns2mock.NoDelayCommsCfg, apns2mock.TokenAuthHandler, apns2mock.AutoCert, apns2mock.AutoKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	clock := apns2mock.NewFakeClock(time.Now())
+	s.SetClock(clock)
+
+	exp := fmt.Sprint(clock.Now().Add(time.Minute).Unix())
+	if status, reason := postHeader(t, s, http.Header{"Apns-Expiration": {exp}}, "{}"); status != 200 {
+		t.Fatalf("got %v %#v, expected 200", status, reason)
+	}
+	clock.Advance(2 * time.Minute)
+	if status, reason := postHeader(t, s, http.Header{"Apns-Expiration": {exp}}, "{}"); status != 200 {
+		t.Fatalf("got %v %#v, expected 200", status, reason)
+	}
+	ns := s.Received()
+	if ns[0].Expired || !ns[1].Expired || ns[0].Expiration.Unix() != clock.Now().Add(-time.Minute).Unix() {
+		t.Errorf("unexpected expiration of %+v", ns)
+	}
+	if !ns[1].Time.Equal(clock.Now()) {
+		t.Errorf("got time %v, expected %v", ns[1].Time, clock.Now())
+	}
+
+	// Provider tokens expire an hour after being issued.
+	clock.Advance(time.Hour)
+	if status, reason := post(t, s, "", "{}"); status != 403 || reason != "ExpiredProviderToken" {
+		t.Errorf("got %v %#v, expected 403 \"ExpiredProviderToken\"", status, reason)
+	}
+
+	// Schedule phases only end when the clock is advanced.
+	if err := s.StartSchedule(apns2mock.Schedule{Phases: []apns2mock.Phase{{Duration: time.Hour, Status: 503}}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := clock.WaitForWaiters(1, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if status, _ := post(t, s, "", "{}"); status != 503 {
+		t.Errorf("got %v, expected 503", status)
+	}
+	clock.Advance(time.Hour)
+	for i := 0; ; i++ {
+		if status, _ := post(t, s, "", "{}"); status != 503 {
+			break
+		}
+		if i == 100 {
+			t.Fatal("schedule should have ended")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestConnections(t *testing.T) {
+	started, release := make(chan struct{}, 1), make(chan struct{})
+	handler := &apns2mock.CaseHandler{
+		CaseHandlers: []apns2mock.HadlerFunc{
+			func(req *apns2mock.APNSRequest) (int, string) {
+				if req.DeviceToken == "bb01" {
+					started <- struct{}{}
+					<-release
+				}
+				return 0, ""
+			},
+		},
+	}
+	s, err := apns2mock.NewServer(apns2mock.NoDelayCommsCfg, handler, apns2mock.AutoCert, apns2mock.AutoKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	if cs := s.Connections(); len(cs) != 0 {
+		t.Fatalf("got %v connections, expected none", len(cs))
+	}
+	for i := 0; i < 3; i++ {
+		if status, _ := post(t, s, "alert", "{}"); status != 200 {
+			t.Fatalf("got %v, expected 200", status)
+		}
+	}
+	done := make(chan struct{})
+	go func() {
+		postToken(t, s, "bb01")
+		close(done)
+	}()
+	<-started
+	cs := s.Connections()
+	close(release)
+	<-done
+	if len(cs) != 1 {
+		t.Fatalf("got %v connections, expected 1", len(cs))
+	}
+	c := cs[0]
+	if c.ID != s.Received()[0].ConnID || c.RemoteAddr == "" || c.Accepted.IsZero() {
+		t.Errorf("unexpected connection %+v", c)
+	}
+	if c.Streams != 3 || c.ActiveStreams != 1 {
+		t.Errorf("got %v served and %v active streams, expected 3 and 1", c.Streams, c.ActiveStreams)
+	}
+	if c.TLSVersion == 0 || c.CipherSuite == 0 {
+		t.Errorf("got TLS version %x and cipher suite %x", c.TLSVersion, c.CipherSuite)
+	}
+	if c.Team != "TEAM000001" || c.Key != "KEY0000001" {
+		t.Errorf("got team %#v and key %#v", c.Team, c.Key)
+	}
+	// Requests are recorded after connection counters are updated.
+	if _, err := s.WaitForCount(4, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if c = s.Connections()[0]; c.Streams != 4 || c.ActiveStreams != 0 {
+		t.Errorf("got %v served and %v active streams, expected 4 and 0", c.Streams, c.ActiveStreams)
+	}
+}
@@ -0,0 +1,165 @@
+// Copyright 2017 Aleksey Blinov. All rights reserved.
+
+package example
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/baobabus/go-apnsmock/apns2mock"
+	"golang.org/x/net/http2"
+)
+
+// dialTLS performs TLS handshake with the server and returns
+// the resulting connection state.
+func dialTLS(s *apns2mock.Server, cfg *tls.Config) (tls.ConnectionState, error) {
+	rCert, _ := x509.ParseCertificate(s.RootCertificate.Certificate[0])
+	cfg.RootCAs = x509.NewCertPool()
+	cfg.RootCAs.AddCert(rCert)
+	conn, err := tls.Dial("tcp", strings.TrimPrefix(s.URL, "https://"), cfg)
+	if err != nil {
+		return tls.ConnectionState{}, err
+	}
+	defer conn.Close()
+	return conn.ConnectionState(), nil
+}
+
+func TestTLSCfg(t *testing.T) {
+	cfg := apns2mock.NoDelayCommsCfg
+	cfg.TLS = apns2mock.TLSCfg{
+		MaxVersion:       tls.VersionTLS12,
+		CipherSuites:     []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384},
+		CurvePreferences: []tls.CurveID{tls.CurveP384},
+	}
+	s, err := apns2mock.NewServer(cfg, apns2mock.AllOkayHandler, apns2mock.AutoCert, apns2mock.AutoKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	cs, err := dialTLS(s, &tls.Config{NextProtos: []string{http2.NextProtoTLS}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cs.Version != tls.VersionTLS12 || cs.CipherSuite != tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384 || cs.NegotiatedProtocol != http2.NextProtoTLS {
+		t.Errorf("negotiated version %x, cipher suite %x and protocol %#v", cs.Version, cs.CipherSuite, cs.NegotiatedProtocol)
+	}
+	if _, err := dialTLS(s, &tls.Config{CurvePreferences: []tls.CurveID{tls.CurveP256}}); err == nil {
+		t.Error("expected handshake to fail without common curve")
+	}
+	if status, _ := post(t, s, "alert", "{}"); status != 200 {
+		t.Errorf("got %v, expected 200", status)
+	}
+}
+
+func TestTLSCfgVersionAndALPN(t *testing.T) {
+	cfg := apns2mock.NoDelayCommsCfg
+	cfg.TLS = apns2mock.TLSCfg{
+		MinVersion: tls.VersionTLS13,
+		NextProtos: []string{"http/1.1"},
+	}
+	s, err := apns2mock.NewServer(cfg, apns2mock.AllOkayHandler, apns2mock.AutoCert, apns2mock.AutoKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	if _, err := dialTLS(s, &tls.Config{MaxVersion: tls.VersionTLS12}); err == nil {
+		t.Error("expected TLS 1.2 handshake to fail")
+	}
+	cs, err := dialTLS(s, &tls.Config{NextProtos: []string{http2.NextProtoTLS, "http/1.1"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cs.Version != tls.VersionTLS13 || cs.NegotiatedProtocol != "http/1.1" {
+		t.Errorf("negotiated version %x and protocol %#v", cs.Version, cs.NegotiatedProtocol)
+	}
+	// Pre-configured client requires h2.
+	resp, err := s.Client().Post(s.URL+apns2mock.RequestRoot+"abcd", "application/json", strings.NewReader("{}"))
+	if err == nil {
+		resp.Body.Close()
+		t.Error("expected HTTP/2 client to fail")
+	}
+}
+
+func TestHandshakeFaults(t *testing.T) {
+	s, err := apns2mock.NewServer(apns2mock.NoDelayCommsCfg, apns2mock.AllOkayHandler, apns2mock.AutoCert, apns2mock.AutoKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	cases := []struct {
+		fault apns2mock.HandshakeFault
+		err   string
+	}{
+		{apns2mock.ExpiredCert, "expired"},
+		{apns2mock.WrongHost, "wrong.host.invalid"},
+		{apns2mock.UntrustedIssuer, "unknown authority"},
+		{apns2mock.HandshakeAlert, "internal error"},
+	}
+	for _, c := range cases {
+		if err := s.SetHandshakeFaults(apns2mock.HandshakeFaults{Fault: c.fault, Every: 2}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := dialTLS(s, &tls.Config{ServerName: "api.push.apple.com"}); err != nil {
+			t.Errorf("%v: first attempt failed with %v", c.fault, err)
+		}
+		if _, err := dialTLS(s, &tls.Config{ServerName: "api.push.apple.com"}); err == nil || !strings.Contains(err.Error(), c.err) {
+			t.Errorf("%v: got %v, expected error mentioning %#v", c.fault, err, c.err)
+		}
+	}
+
+	if err := s.SetHandshakeFaults(apns2mock.HandshakeFaults{Fault: apns2mock.StallHandshake}); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	conn, err := tls.DialWithDialer(&net.Dialer{Timeout: 200 * time.Millisecond}, "tcp", strings.TrimPrefix(s.URL, "https://"), &tls.Config{InsecureSkipVerify: true})
+	if err == nil {
+		conn.Close()
+		t.Error("expected stalled handshake to time out")
+	} else if d := time.Since(start); d < 200*time.Millisecond {
+		t.Errorf("handshake failed with %v after %v, expected timeout", err, d)
+	}
+
+	if err := s.SetHandshakeFaults(apns2mock.HandshakeFaults{Fault: apns2mock.HandshakeAlert, Percent: 50, Seed: 1}); err != nil {
+		t.Fatal(err)
+	}
+	failed := 0
+	for i := 0; i < 20; i++ {
+		if _, err := dialTLS(s, &tls.Config{}); err != nil {
+			failed++
+		}
+	}
+	if failed == 0 || failed == 20 {
+		t.Errorf("%v of 20 attempts failed, expected about half", failed)
+	}
+	if n := s.Stats().HandshakeFaults; n != uint64(5+failed) {
+		t.Errorf("got %v handshake faults, expected %v", n, 5+failed)
+	}
+
+	s.SetHandshakeFaults(apns2mock.HandshakeFaults{})
+	if status, _ := post(t, s, "alert", "{}"); status != 200 {
+		t.Errorf("got %v, expected 200", status)
+	}
+}
+
+func TestParseHandshakeFaults(t *testing.T) {
+	f, err := apns2mock.ParseHandshakeFaults("expired-cert/3")
+	if err != nil || f.Fault != apns2mock.ExpiredCert || f.Every != 3 {
+		t.Errorf("got %+v %v", f, err)
+	}
+	f, err = apns2mock.ParseHandshakeFaults("stall/25%")
+	if err != nil || f.Fault != apns2mock.StallHandshake || f.Percent != 25 {
+		t.Errorf("got %+v %v", f, err)
+	}
+	for _, spec := range []string{"broken", "alert/0", "alert/150%", "alert/x"} {
+		if _, err := apns2mock.ParseHandshakeFaults(spec); err == nil {
+			t.Errorf("%v: expected error", spec)
+		}
+	}
+}
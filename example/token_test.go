@@ -0,0 +1,133 @@
+// Copyright 2017 Aleksey Blinov. All rights reserved.
+
+package example
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/baobabus/go-apnsmock/apns2mock"
+	jwt "github.com/dgrijalva/jwt-go"
+)
+
+// testKey is used for signing provider tokens in tests
+// that do not verify token signatures.
+var testKey, _ = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+func signToken(t *testing.T, teamID, keyID string, key *ecdsa.PrivateKey) string {
+	token := jwt.NewWithClaims(jwt.SigningMethodES256, jwt.MapClaims{
+		"iss": teamID,
+		"iat": time.Now().Unix(),
+	})
+	token.Header["kid"] = keyID
+	res, err := token.SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res
+}
+
+func TestProviderTokenSignature(t *testing.T) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	other, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := apns2mock.NewProviderKeys()
+	if err := keys.AddP8("TEAM000001", "KEY0000001", pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})); err != nil {
+		t.Fatal(err)
+	}
+	handler := &apns2mock.CaseHandler{
+		CaseHandlers: apns2mock.TokenAuthHandler.CaseHandlers,
+		ProviderKeys: keys,
+	}
+	s, err := apns2mock.NewServer(apns2mock.NoDelayCommsCfg, handler, apns2mock.AutoCert, apns2mock.AutoKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	cases := []struct {
+		name   string
+		token  string
+		status int
+	}{
+		{"valid", signToken(t, "TEAM000001", "KEY0000001", key), 200},
+		{"wrong key", signToken(t, "TEAM000001", "KEY0000001", other), 403},
+		{"unknown key ID", signToken(t, "TEAM000001", "KEY0000002", key), 403},
+		{"wrong team", signToken(t, "TEAM000002", "KEY0000001", key), 403},
+	}
+	for _, c := range cases {
+		req, _ := http.NewRequest("POST", s.URL+apns2mock.RequestRoot+"abcd", strings.NewReader("{}"))
+		req.Header.Set("apns-topic", "com.example.app")
+		req.Header.Set("authorization", "bearer "+c.token)
+		resp, err := s.Client().Do(req)
+		if err != nil {
+			t.Fatalf("%v: %v", c.name, err)
+		}
+		var body struct{ Reason string }
+		json.NewDecoder(resp.Body).Decode(&body)
+		resp.Body.Close()
+		if resp.StatusCode != c.status {
+			t.Errorf("%v: got status %v, expected %v", c.name, resp.StatusCode, c.status)
+		}
+		if c.status == 403 && body.Reason != "InvalidProviderToken" {
+			t.Errorf("%v: got reason %#v, expected \"InvalidProviderToken\"", c.name, body.Reason)
+		}
+	}
+}
+
+func TestTokenUpdates(t *testing.T) {
+	handler := &apns2mock.CaseHandler{
+		CaseHandlers: apns2mock.NewTokenUpdateHandlers(apns2mock.TokenUpdateLimits{
+			ConnInterval: 300 * time.Millisecond,
+			TeamMax:      2,
+			TeamWindow:   time.Hour,
+		}),
+	}
+	s, err := apns2mock.NewServer(apns2mock.NoDelayCommsCfg, handler, apns2mock.AutoCert, apns2mock.AutoKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	first, second := s.Client(), certClient(s, nil, nil)
+	a := signToken(t, "TEAM000001", "KEY0000001", testKey)
+	b := signToken(t, "TEAM000001", "KEY0000001", testKey)
+	c := signToken(t, "TEAM000001", "KEY0000001", testKey)
+	other := signToken(t, "TEAM000002", "KEY0000002", testKey)
+	expect := func(name string, client *http.Client, token string, status int) {
+		req, _ := http.NewRequest("POST", s.URL+apns2mock.RequestRoot+"abcd", strings.NewReader("{}"))
+		req.Header.Set("apns-topic", "com.example.app")
+		req.Header.Set("authorization", "bearer "+token)
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("%v: %v", name, err)
+		}
+		var body struct{ Reason string }
+		json.NewDecoder(resp.Body).Decode(&body)
+		resp.Body.Close()
+		if resp.StatusCode != status || (status == 429 && body.Reason != "TooManyProviderTokenUpdates") {
+			t.Errorf("%v: got %v %#v, expected %v", name, resp.StatusCode, body.Reason, status)
+		}
+	}
+	expect("first token", first, a, 200)
+	expect("same token", first, a, 200)
+	expect("early update", first, b, 429)
+	expect("new connection", second, b, 200)
+	time.Sleep(350 * time.Millisecond)
+	expect("third team token", first, c, 429)
+	expect("known team token", first, b, 200)
+	expect("other team", second, other, 200)
+	first.CloseIdleConnections()
+	expect("reconnected", first, a, 200)
+}